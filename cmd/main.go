@@ -1,9 +1,16 @@
 package main
 
 import (
+	"errors"
+	"github.com/TokDenis/micro-blog/config"
 	"github.com/TokDenis/micro-blog/services"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var api *services.Api
@@ -11,16 +18,97 @@ var api *services.Api
 // todo https
 
 func main() {
-	os.Mkdir("db", os.ModePerm)
-	var err error
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
+
+	db, err := openStorage(cfg)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return
+	}
 
-	api, err = services.NewApi()
+	api, err = services.NewApi(cfg, db)
 	if err != nil {
 		log.Error().Err(err).Send()
 		return
 	}
 
-	go services.StartProxy()
+	proxy := services.StartProxy(cfg)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-stop
+	log.Info().Msgf("%s, shutting down", sig)
+
+	if err := shutdown(cfg, proxy, db); err != nil {
+		log.Error().Err(err).Msg("shutdown")
+		os.Exit(1)
+	}
+
+	log.Info().Msg("bye")
+}
+
+func shutdown(cfg *config.Config, proxy *fasthttp.Server, db storage.Storage) error {
+	drained := make(chan struct{})
+
+	go func() {
+		if err := proxy.Shutdown(); err != nil {
+			log.Error().Err(err).Msg("proxy shutdown")
+		}
+		if err := api.Shutdown(); err != nil {
+			log.Error().Err(err).Msg("api shutdown")
+		}
+		close(drained)
+	}()
+
+	// buffers are flushed even if some requests are still running
+	select {
+	case <-drained:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Warn().Msg("shutdown timeout, requests are still running")
+	}
+
+	err := api.Close()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func openStorage(cfg *config.Config) (storage.Storage, error) {
+	if cfg.Storage != "bolt" {
+		return storage.NewFile(cfg.DataDir)
+	}
+
+	db, err := storage.NewBolt(cfg.BoltFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Migrate {
+		file, err := storage.NewFile(cfg.DataDir)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		copied, err := storage.Migrate(file, db)
+		switch {
+		case errors.Is(err, storage.ErrNotEmpty):
+			// every start after the first one
+			log.Info().Msgf("%s is already migrated", cfg.BoltFile)
+		case err != nil:
+			db.Close()
+			return nil, err
+		default:
+			log.Info().Msgf("migrated %d records into %s", copied, cfg.BoltFile)
+		}
+	}
 
-	select {}
+	return db, nil
 }
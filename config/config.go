@@ -0,0 +1,363 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config settings of one blog instance.
+// Every field can be set in the yaml file, with an env var and with a
+// command-line flag; flags win over env vars, env vars win over the file.
+type Config struct {
+	DataDir        string   `yaml:"data_dir" env:"MICRO_BLOG_DATA_DIR" flag:"data-dir" usage:"directory of the file storage"`
+	Storage        string   `yaml:"storage" env:"MICRO_BLOG_STORAGE" flag:"storage" usage:"storage backend: file or bolt"`
+	BoltFile       string   `yaml:"bolt_file" env:"MICRO_BLOG_BOLT_FILE" flag:"bolt" usage:"bolt database file"`
+	Migrate        bool     `yaml:"migrate" env:"MICRO_BLOG_MIGRATE" flag:"migrate" usage:"copy the data directory into the bolt file before start"`
+	ApiAddr        string   `yaml:"api_addr" env:"MICRO_BLOG_API_ADDR" flag:"api-addr" usage:"listen address of the api server"`
+	ProxyAddr      string   `yaml:"proxy_addr" env:"MICRO_BLOG_PROXY_ADDR" flag:"proxy-addr" usage:"listen address of the proxy"`
+	StaticRoot     string   `yaml:"static_root" env:"MICRO_BLOG_STATIC_ROOT" flag:"static-root" usage:"directory with the site pages"`
+	AllowedOrigins []string `yaml:"allowed_origins" env:"MICRO_BLOG_ALLOWED_ORIGINS" flag:"allowed-origins" usage:"comma separated CORS origins of the api server"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"MICRO_BLOG_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long to wait for running requests on stop"`
+
+	AdminEmails []string `yaml:"admin_emails" env:"MICRO_BLOG_ADMIN_EMAILS" flag:"admin" usage:"comma separated emails of users granted the admin role on start"`
+
+	TokenTTL           time.Duration `yaml:"token_ttl" env:"MICRO_BLOG_TOKEN_TTL" flag:"token-ttl" usage:"how long a login lasts without being used, signed tokens last it from login"`
+	TokenSweepInterval time.Duration `yaml:"token_sweep_interval" env:"MICRO_BLOG_TOKEN_SWEEP_INTERVAL" flag:"token-sweep-interval" usage:"how often expired tokens and login failures are deleted"`
+	TokenFormat        string        `yaml:"token_format" env:"MICRO_BLOG_TOKEN_FORMAT" flag:"token-format" usage:"session tokens: file, checked in storage, or signed, checked by signature"`
+	TokenAlg           string        `yaml:"token_alg" env:"MICRO_BLOG_TOKEN_ALG" flag:"token-alg" usage:"signing algorithm of signed tokens: HS256 or EdDSA"`
+	TokenKeyRotation   time.Duration `yaml:"token_key_rotation" env:"MICRO_BLOG_TOKEN_KEY_ROTATION" flag:"token-key-rotation" usage:"how often the signing key of signed tokens is replaced"`
+
+	PublicURL    string        `yaml:"public_url" env:"MICRO_BLOG_PUBLIC_URL" flag:"public-url" usage:"address of the site used in links sent by mail"`
+	Mailer       string        `yaml:"mailer" env:"MICRO_BLOG_MAILER" flag:"mailer" usage:"how mails are sent: stdout, file or smtp"`
+	MailFile     string        `yaml:"mail_file" env:"MICRO_BLOG_MAIL_FILE" flag:"mail-file" usage:"file the file mailer appends mails to"`
+	MailFrom     string        `yaml:"mail_from" env:"MICRO_BLOG_MAIL_FROM" flag:"mail-from" usage:"sender address of mails"`
+	MailTokenTTL time.Duration `yaml:"mail_token_ttl" env:"MICRO_BLOG_MAIL_TOKEN_TTL" flag:"mail-token-ttl" usage:"how long verification and reset links work"`
+	SMTPAddr     string        `yaml:"smtp_addr" env:"MICRO_BLOG_SMTP_ADDR" flag:"smtp-addr" usage:"host:port of the smtp relay"`
+	SMTPUser     string        `yaml:"smtp_user" env:"MICRO_BLOG_SMTP_USER" flag:"smtp-user" usage:"smtp username, empty for no auth"`
+	SMTPPassword string        `yaml:"smtp_password" env:"MICRO_BLOG_SMTP_PASSWORD" flag:"smtp-password" usage:"smtp password"`
+
+	TwoFactorRoles  []string      `yaml:"two_factor_roles" env:"MICRO_BLOG_TWO_FACTOR_ROLES" flag:"two-factor-roles" usage:"comma separated roles that work only with two factor authentication on"`
+	TwoFactorIssuer string        `yaml:"two_factor_issuer" env:"MICRO_BLOG_TWO_FACTOR_ISSUER" flag:"two-factor-issuer" usage:"name of the blog in authenticator apps"`
+	PreAuthTTL      time.Duration `yaml:"pre_auth_ttl" env:"MICRO_BLOG_PRE_AUTH_TTL" flag:"pre-auth-ttl" usage:"time to enter the second factor after the password"`
+
+	LoginMaxFailures   int           `yaml:"login_max_failures" env:"MICRO_BLOG_LOGIN_MAX_FAILURES" flag:"login-max-failures" usage:"failed logins that lock an account, half of them start the backoff"`
+	LoginIPMaxFailures int           `yaml:"login_ip_max_failures" env:"MICRO_BLOG_LOGIN_IP_MAX_FAILURES" flag:"login-ip-max-failures" usage:"failed logins that lock an ip, half of them start the backoff"`
+	LoginBackoff       time.Duration `yaml:"login_backoff" env:"MICRO_BLOG_LOGIN_BACKOFF" flag:"login-backoff" usage:"first delay after failed logins, doubled on every next failure"`
+	LoginLockout       time.Duration `yaml:"login_lockout" env:"MICRO_BLOG_LOGIN_LOCKOUT" flag:"login-lockout" usage:"how long a locked account or ip waits"`
+	LoginFailureWindow time.Duration `yaml:"login_failure_window" env:"MICRO_BLOG_LOGIN_FAILURE_WINDOW" flag:"login-failure-window" usage:"failures are forgotten after this time without new ones"`
+
+	OIDCIssuer       string   `yaml:"oidc_issuer" env:"MICRO_BLOG_OIDC_ISSUER" flag:"oidc-issuer" usage:"OpenID Connect provider url, empty turns the login off"`
+	OIDCClientID     string   `yaml:"oidc_client_id" env:"MICRO_BLOG_OIDC_CLIENT_ID" flag:"oidc-client-id" usage:"client id at the provider"`
+	OIDCClientSecret string   `yaml:"oidc_client_secret" env:"MICRO_BLOG_OIDC_CLIENT_SECRET" flag:"oidc-client-secret" usage:"client secret at the provider, empty for a public client"`
+	OIDCRedirectURL  string   `yaml:"oidc_redirect_url" env:"MICRO_BLOG_OIDC_REDIRECT_URL" flag:"oidc-redirect-url" usage:"callback url registered at the provider, by default under public_url"`
+	OIDCScopes       []string `yaml:"oidc_scopes" env:"MICRO_BLOG_OIDC_SCOPES" flag:"oidc-scopes" usage:"comma separated scopes asked from the provider"`
+
+	PostReapproveRatio  float64       `yaml:"post_reapprove_ratio" env:"MICRO_BLOG_POST_REAPPROVE_RATIO" flag:"post-reapprove-ratio" usage:"share of changed lines that sends an edited post back to moderation, 0 never does"`
+	ModerationPageLimit int           `yaml:"moderation_page_limit" env:"MICRO_BLOG_MODERATION_PAGE_LIMIT" flag:"moderation-page-limit" usage:"max posts or audit records returned in one page of moderation"`
+	PostPublishInterval time.Duration `yaml:"post_publish_interval" env:"MICRO_BLOG_POST_PUBLISH_INTERVAL" flag:"post-publish-interval" usage:"how often scheduled posts are checked for publishing"`
+
+	CommentEditWindow   time.Duration `yaml:"comment_edit_window" env:"MICRO_BLOG_COMMENT_EDIT_WINDOW" flag:"comment-edit-window" usage:"how long after posting a comment can be edited"`
+	CommentMaxDepth     int           `yaml:"comment_max_depth" env:"MICRO_BLOG_COMMENT_MAX_DEPTH" flag:"comment-max-depth" usage:"levels of replies returned in a comments tree"`
+	CommentRepliesLimit int           `yaml:"comment_replies_limit" env:"MICRO_BLOG_COMMENT_REPLIES_LIMIT" flag:"comment-replies-limit" usage:"replies per thread returned in a comments tree"`
+	CommentsPageLimit   int           `yaml:"comments_page_limit" env:"MICRO_BLOG_COMMENTS_PAGE_LIMIT" flag:"comments-page-limit" usage:"max comments returned in one page"`
+}
+
+const EnvConfigFile = "MICRO_BLOG_CONFIG"
+
+func Default() *Config {
+	return &Config{
+		DataDir:        "db",
+		Storage:        "file",
+		BoltFile:       "db.bolt",
+		ApiAddr:        ":8080",
+		ProxyAddr:      ":80",
+		StaticRoot:     "/www/micro-blog",
+		AllowedOrigins: []string{"http://localhost:7777", "http://localhost:8080"},
+
+		ShutdownTimeout: time.Second * 10,
+
+		TokenTTL:           time.Hour * 24 * 30,
+		TokenSweepInterval: time.Hour,
+		TokenFormat:        "file",
+		TokenAlg:           "HS256",
+		TokenKeyRotation:   time.Hour * 24 * 30,
+
+		PublicURL:    "http://localhost:7777",
+		Mailer:       "stdout",
+		MailFile:     "mails.txt",
+		MailFrom:     "micro-blog@localhost",
+		MailTokenTTL: time.Hour * 24,
+
+		TwoFactorRoles:  []string{"admin"},
+		TwoFactorIssuer: "micro-blog",
+		PreAuthTTL:      time.Minute * 5,
+
+		LoginMaxFailures:   10,
+		LoginIPMaxFailures: 100,
+		LoginBackoff:       time.Second,
+		LoginLockout:       time.Minute * 15,
+		LoginFailureWindow: time.Hour,
+
+		OIDCScopes: []string{"openid", "email", "profile"},
+
+		PostPublishInterval: time.Minute,
+		ModerationPageLimit: 50,
+
+		CommentEditWindow:   time.Minute * 15,
+		CommentMaxDepth:     5,
+		CommentRepliesLimit: 10,
+		CommentsPageLimit:   50,
+	}
+}
+
+// Load builds the config from defaults, the file given by -config or
+// MICRO_BLOG_CONFIG, env vars and args.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	fields := cfg.fields()
+
+	fs := flag.NewFlagSet("micro-blog", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(EnvConfigFile), "yaml config file")
+
+	flags := make(map[string]string)
+	for _, f := range fields {
+		fs.Var(&flagValue{field: f, values: flags}, f.flag, f.usage)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := os.LookupEnv(f.env); ok {
+			err = f.set(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := flags[f.flag]; ok {
+			err = f.set(v)
+			if err != nil {
+				return nil, fmt.Errorf("-%s: %w", f.flag, err)
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+// OIDCCallback url the provider sends the user back to
+func (c *Config) OIDCCallback() string {
+	if c.OIDCRedirectURL != "" {
+		return c.OIDCRedirectURL
+	}
+	return strings.TrimSuffix(c.PublicURL, "/") + "/api/v1/auth/oidc/callback"
+}
+
+// ApiUpstream address the proxy sends api requests to
+func (c *Config) ApiUpstream() string {
+	if strings.HasPrefix(c.ApiAddr, ":") {
+		return "localhost" + c.ApiAddr
+	}
+	return c.ApiAddr
+}
+
+func (c *Config) validate() error {
+	if c.Storage != "file" && c.Storage != "bolt" {
+		return fmt.Errorf("unknown storage %q", c.Storage)
+	}
+	if c.DataDir == "" {
+		return errors.New("data_dir is empty")
+	}
+	if c.TokenTTL <= 0 || c.TokenSweepInterval <= 0 {
+		return errors.New("token_ttl and token_sweep_interval must be positive")
+	}
+	switch c.TokenFormat {
+	case "file":
+	case "signed":
+		if c.TokenAlg != "HS256" && c.TokenAlg != "EdDSA" {
+			return fmt.Errorf("unknown token_alg %q", c.TokenAlg)
+		}
+		if c.TokenKeyRotation <= 0 {
+			return errors.New("token_key_rotation must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown token_format %q", c.TokenFormat)
+	}
+	if c.LoginMaxFailures < 1 || c.LoginIPMaxFailures < 1 {
+		return errors.New("login_max_failures and login_ip_max_failures must be positive")
+	}
+	if c.LoginFailureWindow < c.LoginLockout {
+		return errors.New("login_failure_window is shorter than login_lockout")
+	}
+	if c.PostReapproveRatio < 0 || c.PostReapproveRatio > 1 {
+		return errors.New("post_reapprove_ratio is not between 0 and 1")
+	}
+	if c.PostPublishInterval <= 0 {
+		return errors.New("post_publish_interval must be positive")
+	}
+	if c.ModerationPageLimit <= 0 {
+		return errors.New("moderation_page_limit must be positive")
+	}
+	if c.CommentMaxDepth <= 0 || c.CommentRepliesLimit <= 0 {
+		return errors.New("comment_max_depth and comment_replies_limit must be positive")
+	}
+	if c.CommentsPageLimit <= 0 {
+		return errors.New("comments_page_limit must be positive")
+	}
+	if c.OIDCIssuer != "" && c.OIDCClientID == "" {
+		return errors.New("oidc_client_id is empty")
+	}
+	switch c.Mailer {
+	case "stdout", "file":
+	case "smtp":
+		if c.SMTPAddr == "" {
+			return errors.New("smtp_addr is empty")
+		}
+	default:
+		return fmt.Errorf("unknown mailer %q", c.Mailer)
+	}
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+
+	err = yaml.Unmarshal(b, &values)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, f := range c.fields() {
+		v, ok := values[f.yaml]
+		if !ok {
+			continue
+		}
+
+		// lists are joined so every source goes through the same parsing
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			v = strings.Join(items, ",")
+		}
+
+		err = f.set(fmt.Sprint(v))
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, f.yaml, err)
+		}
+	}
+
+	return nil
+}
+
+type field struct {
+	yaml, env, flag, usage string
+	value                  reflect.Value
+}
+
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	fields := make([]field, t.NumField())
+	for i := range fields {
+		tag := t.Field(i).Tag
+		fields[i] = field{
+			yaml:  tag.Get("yaml"),
+			env:   tag.Get("env"),
+			flag:  tag.Get("flag"),
+			usage: tag.Get("usage"),
+			value: v.Field(i),
+		}
+	}
+
+	return fields
+}
+
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(v)
+	case int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(v))
+	case float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.value.SetFloat(v)
+	case time.Duration:
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(v))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+// flagValue only records the flag, it is applied after the file and env
+type flagValue struct {
+	field  field
+	values map[string]string
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(s string) error {
+	v.values[v.field.flag] = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.field.value.Kind() == reflect.Bool
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`
+data_dir: /from/file
+api_addr: ":9000"
+proxy_addr: ":9001"
+allowed_origins:
+  - http://a
+  - http://b
+`), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("MICRO_BLOG_API_ADDR", ":9100")
+	os.Setenv("MICRO_BLOG_PROXY_ADDR", ":9101")
+	defer os.Unsetenv("MICRO_BLOG_API_ADDR")
+	defer os.Unsetenv("MICRO_BLOG_PROXY_ADDR")
+
+	cfg, err := Load([]string{"-config", path, "-proxy-addr", "127.0.0.1:9201", "-migrate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.DataDir != "/from/file" {
+		t.Errorf("data_dir from file expected, got %q", cfg.DataDir)
+	}
+	if cfg.ApiAddr != ":9100" {
+		t.Errorf("api_addr from env expected, got %q", cfg.ApiAddr)
+	}
+	if cfg.ProxyAddr != "127.0.0.1:9201" {
+		t.Errorf("proxy_addr from flag expected, got %q", cfg.ProxyAddr)
+	}
+	if !cfg.Migrate {
+		t.Error("migrate flag is not set")
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[1] != "http://b" {
+		t.Errorf("unexpected allowed_origins %v", cfg.AllowedOrigins)
+	}
+	if cfg.StaticRoot != "/www/micro-blog" {
+		t.Errorf("default static_root expected, got %q", cfg.StaticRoot)
+	}
+	if cfg.ApiUpstream() != "localhost:9100" {
+		t.Errorf("unexpected upstream %q", cfg.ApiUpstream())
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	for _, args := range [][]string{
+		{"-comment-max-depth", "0"},
+		{"-comment-replies-limit", "-1"},
+		{"-comments-page-limit", "0"},
+	} {
+		_, err := Load(args)
+		if err == nil {
+			t.Errorf("%v is accepted", args)
+		}
+	}
+}
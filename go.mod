@@ -3,10 +3,12 @@ module github.com/TokDenis/micro-blog
 go 1.16
 
 require (
-	github.com/karrick/godirwalk v1.16.1
 	github.com/kataras/go-sessions/v3 v3.3.0
 	github.com/lab259/cors v0.2.0
 	github.com/rs/zerolog v1.20.0
 	github.com/valyala/fasthttp v1.22.0
 	github.com/valyala/fasthttprouter v0.0.0-20160217050331-24073dd8f323
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,446 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// accessTokenPrefix marks personal access tokens, so a leaked one is easy
+// to find with secret scanners
+const accessTokenPrefix = "mbp_"
+
+// AccessTokens personal access tokens for scripts. A token is
+// mbp_<id>_<secret>, only its sha256 is stored.
+type AccessTokens struct {
+	db storage.Storage
+}
+
+type accessTokenRecord struct {
+	types.AccessToken
+	Email string `json:"email"`
+	Hash  string `json:"hash"`
+}
+
+func NewAccessTokens(db storage.Storage) *AccessTokens {
+	return &AccessTokens{db: db}
+}
+
+func (t *AccessTokens) Create(email string, req types.AccessTokenReq) (*types.NewAccessToken, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return nil, ErrAccessTokenName
+	}
+
+	if len(req.Scopes) == 0 {
+		return nil, ErrUnknownScope
+	}
+	for _, scope := range req.Scopes {
+		if !hasString(types.Scopes, scope) {
+			return nil, ErrUnknownScope
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+
+	token := accessTokenPrefix + id + "_" + secret
+
+	record := accessTokenRecord{
+		AccessToken: types.AccessToken{
+			Id:      id,
+			Name:    req.Name,
+			Scopes:  req.Scopes,
+			Created: time.Now(),
+		},
+		Email: email,
+		Hash:  hashAccessToken(token),
+	}
+
+	err = t.db.Update(func(tx storage.Tx) error {
+		err := writeAccessToken(tx, &record)
+		if err != nil {
+			return err
+		}
+
+		ids, err := userAccessTokens(tx, email)
+		if err != nil {
+			return err
+		}
+
+		return setUserAccessTokens(tx, email, append(ids, id))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.NewAccessToken{Token: token, AccessToken: record.AccessToken}, nil
+}
+
+// List access tokens of the user, without the tokens themselves
+func (t *AccessTokens) List(email string) (list []types.AccessToken, err error) {
+	ids, err := userAccessTokens(t.db, email)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		record, err := readAccessToken(t.db, id)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, record.AccessToken)
+	}
+
+	return list, nil
+}
+
+// Revoke deletes an access token of the user
+func (t *AccessTokens) Revoke(email, id string) error {
+	return t.db.Update(func(tx storage.Tx) error {
+		ids, err := userAccessTokens(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if !hasString(ids, id) {
+			return ErrAccessTokenNotFound
+		}
+
+		err = tx.Delete(storage.AccessTokens, id)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		filter := ids[:0]
+		for _, i := range ids {
+			if i != id {
+				filter = append(filter, i)
+			}
+		}
+
+		return setUserAccessTokens(tx, email, filter)
+	})
+}
+
+// Authenticate owner of the token, if the token has the scope
+func (t *AccessTokens) Authenticate(token, scope string) (email string, err error) {
+	id, ok := accessTokenId(token)
+	if !ok {
+		return "", ErrAccessTokenInvalid
+	}
+
+	// most calls only read, LastUsed is written once a minute
+	record, err := checkAccessToken(t.db, id, token, scope)
+	if err != nil {
+		return "", err
+	}
+
+	if !lastUseStale(record, time.Now()) {
+		return record.Email, nil
+	}
+
+	err = t.db.Update(func(tx storage.Tx) error {
+		record, err := checkAccessToken(tx, id, token, scope)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if !lastUseStale(record, now) {
+			return nil
+		}
+		record.LastUsed = &now
+
+		return writeAccessToken(tx, record)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return record.Email, nil
+}
+
+// checkAccessToken record of the token, if the token matches it and has
+// the scope
+func checkAccessToken(tx storage.Tx, id, token, scope string) (*accessTokenRecord, error) {
+	record, err := readAccessToken(tx, id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrAccessTokenInvalid
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(record.Hash), []byte(hashAccessToken(token))) != 1 {
+		return nil, ErrAccessTokenInvalid
+	}
+
+	if !hasString(record.Scopes, scope) {
+		return nil, ErrScopeMissing
+	}
+
+	return record, nil
+}
+
+// lastUseStale minute precision is enough, and scripts do not write on
+// every call
+func lastUseStale(record *accessTokenRecord, now time.Time) bool {
+	return record.LastUsed == nil || now.Sub(*record.LastUsed) >= time.Minute
+}
+
+// accessTokenId id part of mbp_<id>_<secret>
+func accessTokenId(token string) (string, bool) {
+	if !strings.HasPrefix(token, accessTokenPrefix) {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, accessTokenPrefix), "_")
+	if len(parts) != 2 || len(parts[0]) != 16 {
+		return "", false
+	}
+
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func readAccessToken(tx storage.Tx, id string) (*accessTokenRecord, error) {
+	b, err := tx.Read(storage.AccessTokens, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var record accessTokenRecord
+
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func writeAccessToken(tx storage.Tx, record *accessTokenRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.AccessTokens, record.Id, b)
+}
+
+func userAccessTokens(tx storage.Tx, email string) (ids []string, err error) {
+	b, err := tx.Read(storage.UserAccessTokens, email)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func setUserAccessTokens(tx storage.Tx, email string, ids []string) error {
+	if len(ids) == 0 {
+		err := tx.Delete(storage.UserAccessTokens, email)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.UserAccessTokens, email, b)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope marks a route as open to access tokens with the scope,
+// it wraps AuthMiddleware: RequireScope(scope, AuthMiddleware(h))
+func (a *Api) RequireScope(scope string, next fasthttprouter.Handle) fasthttprouter.Handle {
+	return func(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+		ctx.SetUserValue("_scope", scope)
+		next(ctx, p)
+	}
+}
+
+// bearerAuth AuthMiddleware for requests with an access token
+func (a *Api) bearerAuth(ctx *fasthttp.RequestCtx, p fasthttprouter.Params, header string, next fasthttprouter.Handle) {
+	scope, ok := ctx.UserValue("_scope").(string)
+	if !ok {
+		// the route is for sessions only
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	email, err := a.accessTokens.Authenticate(token, scope)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAccessTokenInvalid):
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		case errors.Is(err, ErrScopeMissing):
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			_, _ = ctx.Write([]byte(err.Error()))
+		default:
+			a.internalErr(ctx, err)
+		}
+		return
+	}
+
+	ctx.SetUserValue("_email", email)
+	next(ctx, p)
+}
+
+// optionalBearer sets the owner of a valid access token with the scope of
+// the route, any other token leaves the request anonymous
+func (a *Api) optionalBearer(ctx *fasthttp.RequestCtx, header string) {
+	scope, ok := ctx.UserValue("_scope").(string)
+	token := strings.TrimPrefix(header, "Bearer ")
+	if !ok || token == header {
+		return
+	}
+
+	email, err := a.accessTokens.Authenticate(token, scope)
+	if err != nil {
+		if !errors.Is(err, ErrAccessTokenInvalid) && !errors.Is(err, ErrScopeMissing) {
+			log.Error().Err(err).Msg("optional access token")
+		}
+		return
+	}
+
+	ctx.SetUserValue("_email", email)
+}
+
+func (a *Api) CreateAccessToken(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.AccessTokenReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	token, err := a.accessTokens.Create(email, req)
+	if err != nil {
+		if errors.Is(err, ErrUnknownScope) || errors.Is(err, ErrAccessTokenName) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			_, _ = ctx.Write([]byte(err.Error()))
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	log.Info().Str("email", email).Str("id", token.Id).Strs("scopes", token.Scopes).Msg("access token created")
+
+	b, err := json.Marshal(token)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) AccessTokens(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	list, err := a.accessTokens.List(ctx.UserValue("_email").(string))
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) RevokeAccessToken(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	err := a.accessTokens.Revoke(ctx.UserValue("_email").(string), p.ByName("id"))
+	if err != nil {
+		if errors.Is(err, ErrAccessTokenNotFound) {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+var ErrAccessTokenInvalid = errors.New("invalid access token")
+var ErrAccessTokenNotFound = errors.New("access token not found")
+var ErrAccessTokenName = errors.New("access token name is empty or too long")
+var ErrUnknownScope = errors.New("unknown scope")
+var ErrScopeMissing = errors.New("access token has no scope for this")
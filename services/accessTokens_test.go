@@ -0,0 +1,78 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"strings"
+	"testing"
+)
+
+func TestAccessTokens(t *testing.T) {
+	db := &updateCounter{Storage: storage.NewMemory()}
+	tokens := NewAccessTokens(db)
+
+	_, err := tokens.Create("user@example.com", types.AccessTokenReq{Name: "ci", Scopes: []string{"posts:delete"}})
+	if !errors.Is(err, ErrUnknownScope) {
+		t.Errorf("unknown scope is accepted: %v", err)
+	}
+
+	created, err := tokens.Create("user@example.com", types.AccessTokenReq{Name: "ci", Scopes: []string{types.ScopePostsWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := db.Read(storage.AccessTokens, created.Id)
+	if len(b) == 0 || strings.Contains(string(b), created.Token) {
+		t.Error("token is stored in plain text")
+	}
+
+	email, err := tokens.Authenticate(created.Token, types.ScopePostsWrite)
+	if err != nil || email != "user@example.com" {
+		t.Fatalf("authenticate: %q %v", email, err)
+	}
+
+	_, err = tokens.Authenticate(created.Token, types.ScopeCommentsWrite)
+	if !errors.Is(err, ErrScopeMissing) {
+		t.Errorf("token is accepted without the scope: %v", err)
+	}
+
+	changed := created.Token[:len(created.Token)-1] + "0"
+	if changed == created.Token {
+		changed = created.Token[:len(created.Token)-1] + "1"
+	}
+	_, err = tokens.Authenticate(changed, types.ScopePostsWrite)
+	if !errors.Is(err, ErrAccessTokenInvalid) {
+		t.Errorf("changed token is accepted: %v", err)
+	}
+
+	// LastUsed was just written
+	db.updates = 0
+	_, err = tokens.Authenticate(created.Token, types.ScopePostsWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.updates != 0 {
+		t.Errorf("token used again within a minute is written %d times", db.updates)
+	}
+
+	list, _ := tokens.List("user@example.com")
+	if len(list) != 1 || list[0].LastUsed == nil {
+		t.Fatalf("list: %+v", list)
+	}
+
+	err = tokens.Revoke("other@example.com", created.Id)
+	if !errors.Is(err, ErrAccessTokenNotFound) {
+		t.Errorf("token is revoked by another user: %v", err)
+	}
+
+	err = tokens.Revoke("user@example.com", created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.Authenticate(created.Token, types.ScopePostsWrite)
+	if !errors.Is(err, ErrAccessTokenInvalid) {
+		t.Errorf("revoked token is accepted: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+// RequireVerified lets through users who confirmed their email, goes
+// inside AuthMiddleware
+func (a *Api) RequireVerified(next fasthttprouter.Handle) fasthttprouter.Handle {
+	return func(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+		user, err := a.auth.UserInfo(ctx.UserValue("_email").(string))
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+
+		if user.Unverified {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			_, _ = ctx.Write([]byte("email is not verified"))
+			return
+		}
+
+		next(ctx, p)
+	}
+}
+
+// SendVerification mails the verification link again
+func (a *Api) SendVerification(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	err := a.auth.SendVerification(ctx.UserValue("_email").(string))
+	if err != nil {
+		if errors.Is(err, ErrAlreadyVerified) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			_, _ = ctx.Write([]byte(err.Error()))
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (a *Api) VerifyEmail(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.MailTokenReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = a.auth.Verify(req.Token)
+	if err != nil {
+		a.mailTokenErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// RequestReset answers the same for known and unknown emails
+func (a *Api) RequestReset(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.ResetReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = a.auth.RequestReset(req.Email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// ResetPassword sets a new password and logs the user out everywhere
+func (a *Api) ResetPassword(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.ResetConfirmReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email, err := a.auth.ResetPassword(req.Token, req.Password)
+	if err != nil {
+		a.mailTokenErr(ctx, err)
+		return
+	}
+
+	_, err = a.token.DeleteSessions(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// EnrollTOTP starts two factor enrollment, ConfirmTOTP finishes it
+func (a *Api) EnrollTOTP(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	enrollment, err := a.auth.EnrollTOTP(ctx.UserValue("_email").(string), a.cfg.TwoFactorIssuer)
+	if err != nil {
+		a.twoFactorErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(enrollment)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// ConfirmTOTP answers with recovery codes, they are not shown again
+func (a *Api) ConfirmTOTP(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.TwoFactorCodeReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	codes, err := a.auth.ConfirmTOTP(ctx.UserValue("_email").(string), req.Code)
+	if err != nil {
+		a.twoFactorErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(types.RecoveryCodes{Codes: codes})
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// DisableTOTP is refused to users with a role that requires two factors
+func (a *Api) DisableTOTP(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.TwoFactorCodeReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	user, err := a.auth.UserInfo(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	if len(withoutRoles(user.Roles, a.cfg.TwoFactorRoles)) != len(user.Roles) {
+		a.twoFactorErr(ctx, ErrTwoFactorRequired)
+		return
+	}
+
+	err = a.auth.DisableTOTP(email, req.Code)
+	if err != nil {
+		a.twoFactorErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// LoginSecondFactor second step of LoginUser for users with two factors
+func (a *Api) LoginSecondFactor(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.TwoFactorLoginReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email, err := a.preAuth.Email(req.PreAuthToken)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(ctx)
+
+	retry, err := a.guard.Check(email, ip)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+	if retry > 0 {
+		tooManyAttempts(ctx, retry)
+		return
+	}
+
+	err = a.auth.CheckSecondFactor(email, req.Code)
+	if err != nil {
+		if errors.Is(err, ErrIncorrectCode) {
+			err = a.guard.Fail(email, ip)
+			if err != nil {
+				a.internalErr(ctx, err)
+				return
+			}
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	a.preAuth.Delete(req.PreAuthToken)
+
+	a.startSession(ctx, email)
+}
+
+// UnlockLogin forgets failed logins of an account or an ip, admin only
+func (a *Api) UnlockLogin(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.UnlockReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil || req.Email == "" && req.IP == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Email != "" {
+		err = a.guard.Unlock(req.Email)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+	}
+
+	if req.IP != "" {
+		err = a.guard.UnlockIP(req.IP)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+	}
+
+	log.Info().Str("by", ctx.UserValue("_email").(string)).Str("email", req.Email).Str("ip", req.IP).Msg("login unlocked")
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// tooManyAttempts Retry-After is in whole seconds, rounded up
+func tooManyAttempts(ctx *fasthttp.RequestCtx, retry time.Duration) {
+	ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+}
+
+func (a *Api) twoFactorErr(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, ErrTwoFactorRequired):
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		_, _ = ctx.Write([]byte(err.Error()))
+	case errors.Is(err, ErrTwoFactorEnabled), errors.Is(err, ErrTwoFactorNotEnrolled), errors.Is(err, ErrIncorrectCode):
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(err.Error()))
+	default:
+		a.internalErr(ctx, err)
+	}
+}
+
+func (a *Api) mailTokenErr(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, ErrMailTokenInvalid), errors.Is(err, ErrMailTokenExpired),
+		errors.Is(err, ErrMailTokenUsed), errors.Is(err, ErrAlreadyVerified),
+		errors.Is(err, ErrIncorrectPassword), errors.Is(err, fs.ErrNotExist):
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(err.Error()))
+	default:
+		a.internalErr(ctx, err)
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lastMailToken token from the link of the last mail
+func lastMailToken(t *testing.T, mails *bytes.Buffer) string {
+	i := strings.LastIndex(mails.String(), "token=")
+	if i < 0 {
+		t.Fatal("no mail with a token")
+	}
+
+	token, err := url.QueryUnescape(strings.Fields(mails.String()[i+len("token="):])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestVerifyAndReset(t *testing.T) {
+	db := storage.NewMemory()
+	mails := &bytes.Buffer{}
+
+	mailTokens, err := NewMailTokens(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewAuth(db, NewFileMailer(mails), mailTokens, "http://blog.example.com/")
+
+	password := strings.Repeat("a", 64)
+
+	err = auth.Signup(types.NewUserReq{Name: "user", Email: "Name <user@example.com>", Password: password})
+	if !errors.Is(err, ErrIncorrectEmail) {
+		t.Errorf("address with a display name is accepted: %v", err)
+	}
+
+	err = auth.Signup(types.NewUserReq{Name: "user", Email: "user@example.com", Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := auth.UserInfo("user@example.com")
+	if !user.Unverified {
+		t.Error("new user is verified")
+	}
+
+	verify := lastMailToken(t, mails)
+
+	// a token of one purpose does not work for another
+	_, err = auth.ResetPassword(verify, strings.Repeat("b", 64))
+	if !errors.Is(err, ErrMailTokenInvalid) {
+		t.Errorf("verify token resets the password: %v", err)
+	}
+
+	err = auth.Verify(verify + "x")
+	if !errors.Is(err, ErrMailTokenInvalid) {
+		t.Errorf("changed token is accepted: %v", err)
+	}
+
+	err = auth.Verify(verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = auth.Verify(verify)
+	if !errors.Is(err, ErrAlreadyVerified) {
+		t.Errorf("verify token is used twice: %v", err)
+	}
+
+	err = auth.RequestReset("nobody@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = auth.RequestReset("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := lastMailToken(t, mails)
+
+	email, err := auth.ResetPassword(reset, strings.Repeat("b", 64))
+	if err != nil || email != "user@example.com" {
+		t.Fatalf("reset: %q %v", email, err)
+	}
+
+	_, err = auth.ResetPassword(reset, strings.Repeat("c", 64))
+	if !errors.Is(err, ErrMailTokenUsed) {
+		t.Errorf("reset token is used twice: %v", err)
+	}
+
+	_, err = auth.Sigin("user@example.com", strings.Repeat("b", 64))
+	if err != nil {
+		t.Errorf("new password does not work: %v", err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	db := storage.NewMemory()
+
+	mailTokens, err := NewMailTokens(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewAuth(db, NewFileMailer(&bytes.Buffer{}), mailTokens, "")
+
+	err = auth.Signup(types.NewUserReq{Name: "user", Email: "user@example.com", Password: strings.Repeat("a", 64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment, err := auth.EnrollTOTP("user@example.com", "blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/blog:user@example.com?") {
+		t.Errorf("uri %s", enrollment.URI)
+	}
+
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	code := hotp(key, uint64(totpStep(time.Now())), totpDigits)
+
+	err = auth.CheckSecondFactor("user@example.com", code)
+	if !errors.Is(err, ErrTwoFactorNotEnrolled) {
+		t.Errorf("code is accepted before confirmation: %v", err)
+	}
+
+	recovery, err := auth.ConfirmTOTP("user@example.com", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCodesCount {
+		t.Fatalf("got %d recovery codes", len(recovery))
+	}
+
+	// confirming used the code
+	err = auth.CheckSecondFactor("user@example.com", code)
+	if !errors.Is(err, ErrIncorrectCode) {
+		t.Errorf("code is accepted twice: %v", err)
+	}
+
+	err = auth.CheckSecondFactor("user@example.com", strings.ToUpper(recovery[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = auth.CheckSecondFactor("user@example.com", recovery[3])
+	if !errors.Is(err, ErrIncorrectCode) {
+		t.Errorf("recovery code is accepted twice: %v", err)
+	}
+
+	err = auth.DisableTOTP("user@example.com", recovery[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := auth.UserInfo("user@example.com")
+	if user.TOTPEnabled {
+		t.Error("two factor authentication is still on")
+	}
+}
@@ -3,12 +3,15 @@ package services
 import (
 	"encoding/json"
 	"errors"
+	"github.com/TokDenis/micro-blog/config"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/TokDenis/micro-blog/types"
 	"github.com/lab259/cors"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttprouter"
 	"io/fs"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -16,22 +19,30 @@ import (
 )
 
 type Api struct {
-	auth     *Auth
-	post     *Post
-	token    *Tokens
-	stats    *Stats
-	comments *Comments
+	cfg          *config.Config
+	server       *fasthttp.Server
+	auth         *Auth
+	preAuth      *PreAuth
+	guard        *LoginGuard
+	post         *Post
+	token        *Tokens
+	accessTokens *AccessTokens
+	oidc         *OIDC
+	stats        *Stats
+	comments     *Comments
+	moderation   *Moderation
 }
 
 const (
-	TokenKey = "x-token"
+	TokenKey         = "x-token"
+	TotalCountHeader = "X-Total-Count"
 )
 
-func NewApi() (*Api, error) {
+func NewApi(cfg *config.Config, db storage.Storage) (*Api, error) {
 	r := fasthttprouter.New()
 
 	cs := cors.New(cors.Options{
-		AllowedOrigins: []string{"http://localhost:7777", "http://localhost:8080"},
+		AllowedOrigins: cfg.AllowedOrigins,
 		AllowedMethods: []string{
 			fasthttp.MethodHead,
 			fasthttp.MethodGet,
@@ -41,6 +52,7 @@ func NewApi() (*Api, error) {
 			fasthttp.MethodDelete,
 		},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{TotalCountHeader},
 		AllowCredentials: true,
 	})
 
@@ -51,41 +63,131 @@ func NewApi() (*Api, error) {
 		Handler:      cs.Handler(r.Handler),
 	}
 
-	stats := NewStats()
+	stats := NewStats(db)
 
-	post, err := NewPost(stats)
+	post, err := NewPost(db, stats, cfg.PostReapproveRatio, cfg.PostPublishInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := NewCommentsWal(filepath.Join(cfg.DataDir, "wal", "comments"))
+	if err != nil {
+		return nil, err
+	}
+
+	comments, err := NewCommentsService(db, wal, cfg.CommentEditWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	var token *Tokens
+	if cfg.TokenFormat == "signed" {
+		token, err = NewSignedTokens(db, cfg.TokenTTL, cfg.TokenSweepInterval, cfg.TokenAlg, cfg.TokenKeyRotation)
+	} else {
+		token, err = NewTokens(db, cfg.TokenTTL, cfg.TokenSweepInterval)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	mailTokens, err := NewMailTokens(db, cfg.MailTokenTTL)
 	if err != nil {
 		return nil, err
 	}
 
 	api := Api{
-		auth:     NewAuth(),
-		post:     post,
-		token:    NewTokens(),
-		stats:    stats,
-		comments: NewCommentsService(),
+		cfg:     cfg,
+		server:  s,
+		auth:    NewAuth(db, mailer, mailTokens, cfg.PublicURL),
+		preAuth: NewPreAuth(cfg.PreAuthTTL),
+		guard:   NewLoginGuard(db, cfg),
+
+		accessTokens: NewAccessTokens(db),
+		post:         post,
+		moderation:   NewModeration(db, post),
+		token:        token,
+		stats:        stats,
+		comments:     comments,
+	}
+
+	if cfg.OIDCIssuer != "" {
+		api.oidc = NewOIDC(cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCCallback(), cfg.OIDCScopes)
+
+		r.GET("/api/v1/auth/oidc/login", api.OIDCLogin)
+		r.GET("/api/v1/auth/oidc/callback", api.OIDCCallback)
 	}
-	r.POST("/api/v1/adm/valid", api.AuthMiddleware(api.ValidatePost))
+
+	err = api.bootstrapAdmins(cfg.AdminEmails)
+	if err != nil {
+		return nil, err
+	}
+
+	r.POST("/api/v1/adm/valid", api.AuthMiddleware(api.RequireRole(types.RoleModerator, api.ValidatePost)))
+	r.GET("/api/v1/adm/queue", api.AuthMiddleware(api.RequireRole(types.RoleModerator, api.ModerationQueue)))
+	r.POST("/api/v1/adm/moderate", api.AuthMiddleware(api.RequireRole(types.RoleModerator, api.Moderate)))
+	r.GET("/api/v1/adm/audit", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.ModerationLog)))
+	r.POST("/api/v1/adm/roles", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.SetRole)))
+	r.POST("/api/v1/adm/unlock", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.UnlockLogin)))
+	r.GET("/api/v1/adm/trash", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.Trash)))
+	r.POST("/api/v1/adm/restore", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.RestorePost)))
+	r.POST("/api/v1/adm/purge", api.AuthMiddleware(api.RequireRole(types.RoleAdmin, api.PurgePost)))
 
 	r.GET("/api/v1/comments", api.Comments)
-	r.POST("/api/v1/comments/new", api.AuthMiddleware(api.NewComment))
+	r.POST("/api/v1/comments/new", api.RequireScope(types.ScopeCommentsWrite, api.AuthMiddleware(api.RequireVerified(api.NewComment))))
+	r.POST("/api/v1/comments/react", api.RequireScope(types.ScopeCommentsWrite, api.AuthMiddleware(api.ReactComment)))
+	r.GET("/api/v1/comments/revisions", api.RequireScope(types.ScopeCommentsWrite, api.AuthMiddleware(api.CommentRevisions)))
+	r.PUT("/api/v1/comments/:id", api.RequireScope(types.ScopeCommentsWrite, api.AuthMiddleware(api.EditComment)))
+	r.DELETE("/api/v1/comments/:id", api.RequireScope(types.ScopeCommentsWrite, api.AuthMiddleware(api.DeleteComment)))
 
 	r.POST("/api/v1/auth/newuser", api.NewUser)
 	r.POST("/api/v1/auth/login", api.LoginUser)
-	r.POST("/api/v1/auth/logout", api.LoginUser)
+	r.POST("/api/v1/auth/logout", api.LogoutUser)
 	r.GET("/api/v1/auth/userinfo", api.AuthMiddleware(api.UserInfo))
+	r.POST("/api/v1/auth/verify", api.VerifyEmail)
+	r.POST("/api/v1/auth/verify/send", api.AuthMiddleware(api.SendVerification))
+	r.POST("/api/v1/auth/reset", api.RequestReset)
+	r.POST("/api/v1/auth/reset/confirm", api.ResetPassword)
+	r.POST("/api/v1/auth/2fa/enroll", api.AuthMiddleware(api.EnrollTOTP))
+	r.POST("/api/v1/auth/2fa/confirm", api.AuthMiddleware(api.ConfirmTOTP))
+	r.POST("/api/v1/auth/2fa/disable", api.AuthMiddleware(api.DisableTOTP))
+	r.POST("/api/v1/auth/2fa/login", api.LoginSecondFactor)
+	r.GET("/api/v1/auth/access-tokens", api.AuthMiddleware(api.AccessTokens))
+	r.POST("/api/v1/auth/access-tokens", api.AuthMiddleware(api.CreateAccessToken))
+	r.DELETE("/api/v1/auth/access-tokens/:id", api.AuthMiddleware(api.RevokeAccessToken))
+	r.GET("/api/v1/auth/sessions", api.AuthMiddleware(api.Sessions))
+	r.DELETE("/api/v1/auth/sessions", api.AuthMiddleware(api.DeleteSessions))
+	r.DELETE("/api/v1/auth/sessions/:id", api.AuthMiddleware(api.DeleteSession))
 
 	r.GET("/api/v1/post/pages", api.PostsPages)
 	r.GET("/api/v1/post/daytop", api.DayTopPosts)
 	//r.GET("/api/v1/post/next", api.GetPosts)
 	r.GET("/api/v1/post/last", api.LastPosts)
-	r.GET("/api/v1/post", api.OpenPost)
-	r.POST("/api/v1/post/new", api.AuthMiddleware(api.NewPost))
+	r.GET("/api/v1/post", api.OptionalAuth(api.OpenPost))
+	r.GET("/api/v1/post/drafts", api.AuthMiddleware(api.Drafts))
+	r.GET("/api/v1/post/scheduled", api.AuthMiddleware(api.ScheduledPosts))
+	r.GET("/api/v1/post/rejected", api.AuthMiddleware(api.RejectedPosts))
+	r.GET("/api/v1/post/pending", api.AuthMiddleware(api.PendingPosts))
+	r.GET("/api/v1/post/revisions", api.OptionalAuth(api.PostRevisions))
+	r.GET("/api/v1/post/diff", api.OptionalAuth(api.PostDiff))
+	r.PUT("/api/v1/post/:id", api.RequireScope(types.ScopePostsWrite, api.AuthMiddleware(api.RequireVerified(api.EditPost))))
+	r.DELETE("/api/v1/post/:id", api.RequireScope(types.ScopePostsWrite, api.AuthMiddleware(api.DeletePost)))
+	r.POST("/api/v1/post/new", api.RequireScope(types.ScopePostsWrite, api.AuthMiddleware(api.RequireVerified(api.RequireRole(types.RoleAuthor, api.NewPost)))))
+
+	r.GET("/api/v1/tags", api.Tags)
+	r.GET("/api/v1/tags/:tag/posts", api.TagPosts)
+	r.GET("/api/v1/categories", api.Categories)
+	r.GET("/api/v1/categories/:category/posts", api.CategoryPosts)
 
 	r.GET("/api/v1/stats", api.ReadStats)
+	r.GET("/api/v1/metrics", api.Metrics)
 
 	go func() {
-		err := s.ListenAndServe(":8080")
+		err := s.ListenAndServe(cfg.ApiAddr)
 		if err != nil {
 			log.Fatal().Err(err).Send()
 		}
@@ -94,6 +196,26 @@ func NewApi() (*Api, error) {
 	return &api, err
 }
 
+// Shutdown stops accepting requests and waits for the running ones
+func (a *Api) Shutdown() error {
+	return a.server.Shutdown()
+}
+
+// Close writes buffered comments and views, call it after Shutdown
+func (a *Api) Close() error {
+	a.token.Close()
+	a.guard.Close()
+	a.post.Close()
+
+	commentsErr := a.comments.Close()
+	statsErr := a.stats.Close()
+
+	if commentsErr != nil {
+		return commentsErr
+	}
+	return statsErr
+}
+
 func (a *Api) NewUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	var newUserReq types.NewUserReq
 
@@ -114,7 +236,7 @@ func (a *Api) NewUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 		return
 	}
 
-	token, err := a.token.MakeToken(newUserReq.Email)
+	token, err := a.token.MakeToken(newUserReq.Email, string(ctx.UserAgent()), clientIP(ctx))
 	if err != nil {
 		a.internalErr(ctx, err)
 		_, _ = ctx.Write([]byte(err.Error()))
@@ -142,9 +264,26 @@ func (a *Api) LoginUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 		return
 	}
 
+	ip := clientIP(ctx)
+
+	retry, err := a.guard.Check(userReq.Email, ip)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+	if retry > 0 {
+		tooManyAttempts(ctx, retry)
+		return
+	}
+
 	user, err := a.auth.Sigin(userReq.Email, userReq.Password)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrUnauthorized) {
+			err = a.guard.Fail(userReq.Email, ip)
+			if err != nil {
+				a.internalErr(ctx, err)
+				return
+			}
 			ctx.SetStatusCode(fasthttp.StatusBadRequest)
 			return
 		}
@@ -152,7 +291,36 @@ func (a *Api) LoginUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 		return
 	}
 
-	token, err := a.token.MakeToken(user.Email)
+	// the session is made by LoginSecondFactor
+	if user.TOTPEnabled {
+		pre, err := a.preAuth.Make(user.Email)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+
+		b, err := json.Marshal(pre)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		_, _ = ctx.Write(b)
+		return
+	}
+
+	a.startSession(ctx, user.Email)
+}
+
+// startSession logs the user in with a new token
+func (a *Api) startSession(ctx *fasthttp.RequestCtx, email string) {
+	err := a.guard.Succeed(email)
+	if err != nil {
+		log.Error().Err(err).Str("email", email).Msg("reset login failures")
+	}
+
+	token, err := a.token.MakeToken(email, string(ctx.UserAgent()), clientIP(ctx))
 	if err != nil {
 		a.internalErr(ctx, err)
 		return
@@ -183,8 +351,15 @@ func (a *Api) UserInfo(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	_, _ = ctx.Write(b)
 }
 
+// AuthMiddleware accepts a session, or an access token on routes wrapped
+// in RequireScope
 func (a *Api) AuthMiddleware(next fasthttprouter.Handle) fasthttprouter.Handle {
 	return func(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+		if header := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization); len(header) != 0 {
+			a.bearerAuth(ctx, p, string(header), next)
+			return
+		}
+
 		ses := sessions.StartFasthttp(ctx)
 		token, ok := ses.Get(TokenKey).(string)
 		if !ok {
@@ -193,11 +368,44 @@ func (a *Api) AuthMiddleware(next fasthttprouter.Handle) fasthttprouter.Handle {
 		}
 		email, err := a.token.EmailFromToken(token)
 		if err != nil {
-			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrTokenInvalid) {
+				ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+				return
+			}
+			a.internalErr(ctx, err)
 			return
 		}
 
 		ctx.SetUserValue("_email", email)
+		ctx.SetUserValue("_token", token)
+		next(ctx, p)
+	}
+}
+
+// OptionalAuth sets the user of the request like AuthMiddleware when it
+// has one, an anonymous request or a stale session goes on without it. So
+// does a bearer token that is not valid or lacks the scope of the route, a
+// public page does not fail for it.
+func (a *Api) OptionalAuth(next fasthttprouter.Handle) fasthttprouter.Handle {
+	return func(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+		if header := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization); len(header) != 0 {
+			a.optionalBearer(ctx, string(header))
+			next(ctx, p)
+			return
+		}
+
+		// no cookie, no session to start
+		if len(ctx.Request.Header.Cookie(sessions.DefaultCookieName)) != 0 {
+			token, ok := sessions.StartFasthttp(ctx).Get(TokenKey).(string)
+			if ok {
+				email, err := a.token.EmailFromToken(token)
+				if err == nil {
+					ctx.SetUserValue("_email", email)
+					ctx.SetUserValue("_token", token)
+				}
+			}
+		}
+
 		next(ctx, p)
 	}
 }
@@ -234,6 +442,70 @@ func (a *Api) LastPosts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	_, _ = ctx.Write(b)
 }
 
+// Tags tags of published posts with their number of posts
+func (a *Api) Tags(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.tagCounts(ctx, a.post.TagCounts())
+}
+
+// Categories categories of published posts with their number of posts
+func (a *Api) Categories(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.tagCounts(ctx, a.post.CategoryCounts())
+}
+
+// TagPosts published posts with the tag, paged like LastPosts
+func (a *Api) TagPosts(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	a.tagPosts(ctx, p.ByName("tag"), a.post.TagPosts)
+}
+
+// CategoryPosts published posts in the category, paged like LastPosts
+func (a *Api) CategoryPosts(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	a.tagPosts(ctx, p.ByName("category"), a.post.CategoryPosts)
+}
+
+func (a *Api) tagCounts(ctx *fasthttp.RequestCtx, counts []types.TagCount) {
+	b, err := json.Marshal(&counts)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) tagPosts(ctx *fasthttp.RequestCtx, tag string, list func(string, int) ([]*types.Post, int, error)) {
+	var page int
+	var err error
+
+	pageString := string(ctx.QueryArgs().Peek("page"))
+	if pageString != "" {
+		page, err = strconv.Atoi(pageString)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		if page > 0 {
+			page--
+		}
+	}
+
+	posts, total, err := list(tag, page)
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(&posts)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.Response.Header.Set(TotalCountHeader, strconv.Itoa(total))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
 func (a *Api) DayTopPosts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	ts, err := time.Parse("2006-01-02", string(ctx.QueryArgs().Peek("day")))
 	if err != nil {
@@ -295,13 +567,32 @@ func (a *Api) OpenPost(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
 
 	post, err := a.post.ReadPost(id)
 	if err != nil {
+		// ids of purged posts are not reused
+		if errors.Is(err, fs.ErrNotExist) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
 		a.internalErr(ctx, err)
 		return
 	}
 
-	if !post.IsValid() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return
+	// the author opens a hidden post with the reason of its moderation
+	if post == nil || !post.IsValid() {
+		email, _ := ctx.UserValue("_email").(string)
+		if email == "" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+
+		post, err = a.post.OwnPost(id, email)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				ctx.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+			a.internalErr(ctx, err)
+			return
+		}
 	}
 
 	b, err := json.Marshal(&post)
@@ -333,7 +624,7 @@ func (a *Api) NewPost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 
 	id, err := a.post.CreatePost(postReq, userInfo)
 	if err != nil {
-		a.internalErr(ctx, err)
+		a.postErr(ctx, err)
 		return
 	}
 
@@ -341,79 +632,113 @@ func (a *Api) NewPost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	_, _ = ctx.Write([]byte(strconv.Itoa(id)))
 }
 
-func (a *Api) ReadStats(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
-	var ids []int
-
-	err := json.Unmarshal(ctx.QueryArgs().Peek("ids"), &ids)
+// EditPost replaces the content of a post of the user, moderators edit
+// any. The answer is "reapprove" when the edit hid the post until a
+// moderator approves it again.
+func (a *Api) EditPost(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
 
-	var stats []*types.Stats
+	var postReq types.NewPostReq
 
-	for _, id := range ids {
-		stat, err := a.stats.ReadStats(id)
-		if err != nil {
-			a.internalErr(ctx, err)
-			return
-		}
-		stats = append(stats, stat)
+	err = json.Unmarshal(ctx.PostBody(), &postReq)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
 	}
 
-	b, err := json.Marshal(&stats)
+	email := ctx.UserValue("_email").(string)
+
+	userInfo, err := a.auth.UserInfo(email)
 	if err != nil {
 		a.internalErr(ctx, err)
 		return
 	}
 
-	ctx.SetStatusCode(fasthttp.StatusOK)
-	_, _ = ctx.Write(b)
-}
-
-func (a *Api) PostsPages(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
-	count := a.post.PostsPages()
+	reapprove, err := a.post.Edit(id, postReq, userInfo, a.canUseRole(userInfo, types.RoleModerator))
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
-	_, _ = ctx.Write([]byte(strconv.Itoa(count)))
+	if reapprove {
+		_, _ = ctx.Write([]byte("reapprove"))
+	}
 }
 
-func (a *Api) NewComment(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
-	var commentReq types.NewCommentReq
-
-	err := json.Unmarshal(ctx.PostBody(), &commentReq)
+// PostRevisions replaced versions of a published post, the author sees
+// them for a post in any status. The id is a query arg: a wildcard after
+// /api/v1/post/ conflicts in the router with /api/v1/post/last and the
+// other static routes, so /api/v1/post/{id}/revisions cannot be routed.
+func (a *Api) PostRevisions(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
 
-	email := ctx.UserValue("_email").(string)
+	if !a.canSeeHistory(ctx, id) {
+		return
+	}
 
-	a.comments.Consume(commentReq.PostId, types.Comment{
-		Id:        0,
-		UserName:  email,
-		Content:   commentReq.Content,
-		IsDeleted: false,
-		Created:   time.Now(),
-	})
+	revisions, err := a.post.Revisions(id)
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(&revisions)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
 }
 
-func (a *Api) Comments(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
-	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+// PostDiff changes of a post between revisions from and to, to defaults
+// to the current version. Visible like PostRevisions, with the id a query
+// arg for the same reason.
+func (a *Api) PostDiff(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	args := ctx.QueryArgs()
+
+	id, err := strconv.Atoi(string(args.Peek("id")))
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
 
-	comments, err := a.comments.GetComments(id)
+	from, err := args.GetUint("from")
 	if err != nil {
-		a.internalErr(ctx, err)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
 
-	b, err := json.Marshal(comments)
+	if !a.canSeeHistory(ctx, id) {
+		return
+	}
+
+	to := CurrentRevision
+	if args.Has("to") {
+		to, err = args.GetUint("to")
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	diff, err := a.post.Diff(id, from, to)
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(diff)
 	if err != nil {
 		a.internalErr(ctx, err)
 		return
@@ -423,46 +748,688 @@ func (a *Api) Comments(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
 	_, _ = ctx.Write(b)
 }
 
-func (a *Api) LogoutUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
-	ses := sessions.StartFasthttp(ctx)
-	token, ok := ses.Get(TokenKey).(string)
-	if !ok {
-		a.internalErr(ctx, errors.New("can not get TokenKey"))
-		return
+// canSeeHistory answers 404 unless the post is published or the user of
+// the request wrote it
+func (a *Api) canSeeHistory(ctx *fasthttp.RequestCtx, id int) bool {
+	if a.post.isValidPost(id) {
+		return true
 	}
 
-	err := a.token.DeleteToken(token)
+	email, _ := ctx.UserValue("_email").(string)
+	if email != "" {
+		author, err := a.post.isAuthor(id, email)
+		if err != nil {
+			a.postErr(ctx, err)
+			return false
+		}
+		if author {
+			return true
+		}
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusNotFound)
+	return false
+}
+
+// Drafts drafts of the user
+func (a *Api) Drafts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.postsOfUser(ctx, a.post.Drafts)
+}
+
+// ScheduledPosts approved posts of the user waiting for their time
+func (a *Api) ScheduledPosts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.postsOfUser(ctx, a.post.Scheduled)
+}
+
+// RejectedPosts rejected posts of the user, the reasons are in moderation
+func (a *Api) RejectedPosts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.postsOfUser(ctx, a.post.Rejected)
+}
+
+// PendingPosts posts of the user waiting for a moderator
+func (a *Api) PendingPosts(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	a.postsOfUser(ctx, a.post.Pending)
+}
+
+func (a *Api) postsOfUser(ctx *fasthttp.RequestCtx, list func(email string) ([]*types.Post, error)) {
+	email := ctx.UserValue("_email").(string)
+
+	posts, err := list(email)
 	if err != nil {
 		a.internalErr(ctx, err)
 		return
 	}
 
-	ok = ses.Delete(TokenKey)
-	if !ok {
-		a.internalErr(ctx, errors.New("can not delete TokenKey"))
+	b, err := json.Marshal(&posts)
+	if err != nil {
+		a.internalErr(ctx, err)
 		return
 	}
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
 }
 
-func (a *Api) ValidatePost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
-	if string(ctx.PostBody()) != types.AdminWord {
+// DeletePost moves a post of the user to the trash, moderators delete any
+func (a *Api) DeletePost(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
 
-	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	email := ctx.UserValue("_email").(string)
+
+	moderator, err := a.isModerator(email)
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		a.internalErr(ctx, err)
 		return
 	}
 
-	err = a.post.Validate(id, ctx.QueryArgs().GetBool("v"))
+	err = a.post.Delete(id, email, moderator)
 	if err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		a.postErr(ctx, err)
 		return
 	}
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
+
+// Trash deleted posts, admins only
+func (a *Api) Trash(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	posts, err := a.post.Trash()
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(&posts)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// RestorePost takes a post out of the trash, admins only
+func (a *Api) RestorePost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = a.post.Restore(id)
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// PurgePost deletes a post in the trash for good with its comments, admins only
+func (a *Api) PurgePost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !a.post.isDeleted(id) {
+		a.postErr(ctx, ErrPostNotDeleted)
+		return
+	}
+
+	// comments first, a failed purge leaves the post in the trash to retry
+	err = a.comments.PurgePost(id)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	err = a.post.Purge(id)
+	if err != nil {
+		a.postErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (a *Api) postErr(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, ErrRevisionNotFound):
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	case errors.Is(err, ErrPostNotDeleted), errors.Is(err, ErrPostDraft),
+		errors.Is(err, ErrInvalidTag), errors.Is(err, ErrTooManyTags):
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(err.Error()))
+	case errors.Is(err, ErrForbidden):
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+	case errors.Is(err, ErrDiffTooLarge):
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+		_, _ = ctx.Write([]byte(err.Error()))
+	default:
+		a.internalErr(ctx, err)
+	}
+}
+
+func (a *Api) ReadStats(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	var ids []int
+
+	err := json.Unmarshal(ctx.QueryArgs().Peek("ids"), &ids)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	var stats []*types.Stats
+
+	for _, id := range ids {
+		stat, err := a.stats.ReadStats(id)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+		stats = append(stats, stat)
+	}
+
+	b, err := json.Marshal(&stats)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) PostsPages(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	count := a.post.PostsPages()
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write([]byte(strconv.Itoa(count)))
+}
+
+func (a *Api) NewComment(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var commentReq types.NewCommentReq
+
+	err := json.Unmarshal(ctx.PostBody(), &commentReq)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	// a purge would miss comments of a deleted post
+	if !a.post.isOpen(commentReq.PostId) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte("post not found"))
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	id, err := a.comments.NewId(commentReq.PostId, commentReq.ParentId)
+	if err != nil {
+		if errors.Is(err, ErrParentNotFound) || errors.Is(err, ErrCommentNotFound) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			_, _ = ctx.Write([]byte(ErrParentNotFound.Error()))
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	err = a.comments.Consume(commentReq.PostId, types.Comment{
+		Id:        id,
+		ParentId:  commentReq.ParentId,
+		UserName:  email,
+		Content:   commentReq.Content,
+		IsDeleted: false,
+		Created:   time.Now(),
+	})
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write([]byte(strconv.Itoa(id)))
+}
+
+func (a *Api) Comments(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	// the discussion of a post in the trash is hidden with it
+	if !a.post.isOpen(id) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	var comments interface{}
+
+	if ctx.QueryArgs().GetBool("tree") {
+		comments, err = a.commentsTree(ctx, id)
+	} else {
+		comments, err = a.commentsPage(ctx, id)
+	}
+	if err != nil {
+		if errors.Is(err, errBadQuery) || errors.Is(err, ErrUnknownOrder) || errors.Is(err, ErrUnknownCursor) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(comments)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) EditComment(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	var editReq types.EditCommentReq
+
+	err = json.Unmarshal(ctx.PostBody(), &editReq)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	moderator, err := a.isModerator(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	err = a.comments.Edit(id, email, editReq.Content, moderator)
+	if err != nil {
+		a.commentErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// CommentRevisions earlier contents of a comment of the user, moderators
+// see them for any comment
+func (a *Api) CommentRevisions(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	moderator, err := a.isModerator(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	revisions, err := a.comments.Revisions(id, email, moderator)
+	if err != nil {
+		a.commentErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(&revisions)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+func (a *Api) DeleteComment(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	id, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	email := ctx.UserValue("_email").(string)
+
+	moderator, err := a.isModerator(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	err = a.comments.Delete(id, email, moderator)
+	if err != nil {
+		a.commentErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// ReactComment adds the reaction of the user, v=false removes it
+func (a *Api) ReactComment(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	add := !ctx.QueryArgs().Has("v") || ctx.QueryArgs().GetBool("v")
+
+	email := ctx.UserValue("_email").(string)
+
+	err = a.comments.React(id, email, add)
+	if err != nil {
+		a.commentErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+func (a *Api) commentErr(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, ErrCommentNotFound):
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrEditWindowClosed):
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		_, _ = ctx.Write([]byte(err.Error()))
+	default:
+		a.internalErr(ctx, err)
+	}
+}
+
+// commentsPage comments with after, limit and order query args, the count
+// of all comments goes to the X-Total-Count header
+func (a *Api) commentsPage(ctx *fasthttp.RequestCtx, postId int) ([]*types.Comment, error) {
+	args := ctx.QueryArgs()
+
+	after, err := intArg(args, "after", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := intArg(args, "limit", a.cfg.CommentsPageLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > a.cfg.CommentsPageLimit {
+		limit = a.cfg.CommentsPageLimit
+	}
+
+	order := string(args.Peek("order"))
+	if order == "" {
+		order = CommentsOldest
+	}
+
+	comments, total, err := a.comments.Page(postId, order, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Response.Header.Set(TotalCountHeader, strconv.Itoa(total))
+
+	if comments == nil {
+		comments = []*types.Comment{}
+	}
+
+	return comments, nil
+}
+
+// commentsTree replies of the thread comment (top level by default) with
+// depth, page and limit query args
+func (a *Api) commentsTree(ctx *fasthttp.RequestCtx, postId int) ([]*types.CommentNode, error) {
+	args := ctx.QueryArgs()
+
+	thread, err := intArg(args, "thread", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	depth, err := intArg(args, "depth", a.cfg.CommentMaxDepth)
+	if err != nil {
+		return nil, err
+	}
+	if depth <= 0 || depth > a.cfg.CommentMaxDepth {
+		depth = a.cfg.CommentMaxDepth
+	}
+
+	page, err := intArg(args, "page", 0)
+	if err != nil || page < 0 {
+		return nil, errBadQuery
+	}
+
+	limit, err := intArg(args, "limit", a.cfg.CommentRepliesLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > a.cfg.CommentRepliesLimit {
+		limit = a.cfg.CommentRepliesLimit
+	}
+
+	return a.comments.GetTree(postId, thread, depth, page, limit)
+}
+
+// intArg returns def for a missing arg and errBadQuery for a broken one
+func intArg(args *fasthttp.Args, key string, def int) (int, error) {
+	v := args.Peek(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, errBadQuery
+	}
+
+	return n, nil
+}
+
+var errBadQuery = errors.New("bad query")
+
+func (a *Api) LogoutUser(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	ses := sessions.StartFasthttp(ctx)
+	token, ok := ses.Get(TokenKey).(string)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		return
+	}
+
+	err := a.token.DeleteToken(token)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ok = ses.Delete(TokenKey)
+	if !ok {
+		a.internalErr(ctx, errors.New("can not delete TokenKey"))
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// ValidatePost approves a post, v=false sends it back to the queue. An
+// optional reason is shown to the author. Moderators only.
+func (a *Api) ValidatePost(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	id, err := strconv.Atoi(string(ctx.QueryArgs().Peek("id")))
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	action := types.ModerationUnapprove
+	if ctx.QueryArgs().GetBool("v") {
+		action = types.ModerationApprove
+	}
+
+	moderator, err := a.auth.UserInfo(ctx.UserValue("_email").(string))
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	_, err = a.moderation.moderate(id, action, string(ctx.QueryArgs().Peek("reason")), moderator)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrPostDraft) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// ModerationQueue pending posts with author, q, after and limit query
+// args, the count of all matching posts goes to the X-Total-Count header
+func (a *Api) ModerationQueue(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	args := ctx.QueryArgs()
+
+	after, err := intArg(args, "after", -1)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	limit, err := intArg(args, "limit", a.cfg.ModerationPageLimit)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	if limit <= 0 || limit > a.cfg.ModerationPageLimit {
+		limit = a.cfg.ModerationPageLimit
+	}
+
+	posts, total, err := a.moderation.Queue(string(args.Peek("author")), string(args.Peek("q")), after, limit)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	if posts == nil {
+		posts = []*types.Post{}
+	}
+
+	b, err := json.Marshal(&posts)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.Response.Header.Set(TotalCountHeader, strconv.Itoa(total))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// Moderate applies an action to many posts, the answer has a result per
+// post
+func (a *Api) Moderate(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var req types.ModerationReq
+
+	err := json.Unmarshal(ctx.PostBody(), &req)
+	if err != nil || len(req.Ids) == 0 || len(req.Ids) > a.cfg.ModerationPageLimit {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case types.ModerationApprove, types.ModerationUnapprove, types.ModerationReject:
+	default:
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(ErrUnknownAction.Error()))
+		return
+	}
+
+	if req.Action == types.ModerationReject && req.Reason == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(ErrReasonRequired.Error()))
+		return
+	}
+
+	moderator, err := a.auth.UserInfo(ctx.UserValue("_email").(string))
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	results := a.moderation.Moderate(req.Ids, req.Action, req.Reason, moderator)
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// ModerationLog audit records with post, before and limit query args
+func (a *Api) ModerationLog(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	args := ctx.QueryArgs()
+
+	postId, err := intArg(args, "post", -1)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	before, err := intArg(args, "before", 0)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	limit, err := intArg(args, "limit", a.cfg.ModerationPageLimit)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	if limit <= 0 || limit > a.cfg.ModerationPageLimit {
+		limit = a.cfg.ModerationPageLimit
+	}
+
+	records, err := a.moderation.Log(postId, before, limit)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	if records == nil {
+		records = []*types.ModerationRecord{}
+	}
+
+	b, err := json.Marshal(&records)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
@@ -0,0 +1,366 @@
+package services
+
+import (
+	"fmt"
+	"github.com/TokDenis/micro-blog/config"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/valyala/fasthttp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kataras/go-sessions/v3"
+)
+
+// newTestApi api over the storage, requests go to its handler without a
+// connection. Sessions are shared by every api of the test.
+func newTestApi(t *testing.T, cfg *config.Config, db storage.Storage) *Api {
+	dir := t.TempDir()
+
+	cfg.DataDir = dir
+	cfg.ApiAddr = "127.0.0.1:0"
+	cfg.Mailer = "file"
+	cfg.MailFile = filepath.Join(dir, "mails.txt")
+
+	api, err := NewApi(cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = api.Shutdown()
+		_ = api.Close()
+	})
+
+	return api
+}
+
+// testClient keeps the session cookie between requests, no cookie makes
+// anonymous requests. bearer is sent as an access token.
+type testClient struct {
+	t      *testing.T
+	api    *Api
+	cookie string
+	bearer string
+}
+
+// signup registers the user and keeps its session
+func signup(t *testing.T, api *Api, email string) *testClient {
+	c := &testClient{t: t, api: api}
+
+	body := `{"name":"` + strings.Split(email, "@")[0] + `","email":"` + email + `","password":"` + strings.Repeat("a", 64) + `"}`
+	if resp := c.do("POST", "/api/v1/auth/newuser", body); resp.StatusCode() != fasthttp.StatusOK || c.cookie == "" {
+		t.Fatalf("signup %s: %d %s", email, resp.StatusCode(), resp.Body())
+	}
+
+	return c
+}
+
+func (c *testClient) do(method, uri, body string) *fasthttp.Response {
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.SetBodyString(body)
+	if c.cookie != "" {
+		req.Header.SetCookie(sessions.DefaultCookieName, c.cookie)
+	}
+	if c.bearer != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+c.bearer)
+	}
+
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	c.api.server.Handler(&ctx)
+
+	var cookie fasthttp.Cookie
+	cookie.SetKey(sessions.DefaultCookieName)
+	if ctx.Response.Header.Cookie(&cookie) && len(cookie.Value()) != 0 {
+		c.cookie = string(cookie.Value())
+	}
+
+	var resp fasthttp.Response
+	ctx.Response.CopyTo(&resp)
+
+	return &resp
+}
+
+func TestPostRevisionsAccess(t *testing.T) {
+	api := newTestApi(t, config.Default(), storage.NewMemory())
+
+	author := signup(t, api, "author@example.com")
+	other := signup(t, api, "other@example.com")
+	anonymous := &testClient{t: t, api: api}
+
+	user := &types.UserInfo{Email: "author@example.com", Name: "author"}
+
+	id, err := api.post.CreatePost(types.NewPostReq{Name: "post", MainPost: "one"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.post.Edit(id, types.NewPostReq{Name: "post", MainPost: "two"}, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revisions := "/api/v1/post/revisions?id=" + strconv.Itoa(id)
+	diff := "/api/v1/post/diff?from=0&id=" + strconv.Itoa(id)
+
+	for _, uri := range []string{revisions, diff} {
+		if code := author.do("GET", uri, "").StatusCode(); code != fasthttp.StatusOK {
+			t.Errorf("author of a pending post: %s %d", uri, code)
+		}
+		if code := other.do("GET", uri, "").StatusCode(); code != fasthttp.StatusNotFound {
+			t.Errorf("other user, pending post: %s %d", uri, code)
+		}
+		if code := anonymous.do("GET", uri, "").StatusCode(); code != fasthttp.StatusNotFound {
+			t.Errorf("anonymous, pending post: %s %d", uri, code)
+		}
+	}
+
+	err = api.post.Validate(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := anonymous.do("GET", revisions, "")
+	if resp.StatusCode() != fasthttp.StatusOK || !strings.Contains(string(resp.Body()), `"main_post":"one"`) {
+		t.Errorf("anonymous, published post: %d %s", resp.StatusCode(), resp.Body())
+	}
+
+	// a public page does not fail for a token it does not take
+	created, err := api.accessTokens.Create("other@example.com", types.AccessTokenReq{Name: "ci", Scopes: []string{types.ScopeCommentsWrite}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bearer := range []string{"not-a-token", created.Token} {
+		c := &testClient{t: t, api: api, bearer: bearer}
+		for _, uri := range []string{"/api/v1/post?id=" + strconv.Itoa(id), revisions, diff} {
+			if code := c.do("GET", uri, "").StatusCode(); code != fasthttp.StatusOK {
+				t.Errorf("bearer %s, published post: %s %d", bearer, uri, code)
+			}
+		}
+	}
+
+	_, err = api.post.Edit(id, types.NewPostReq{Name: "post", MainPost: strings.Repeat("line\n", maxDiffLines)}, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := author.do("GET", diff, "").StatusCode(); code != fasthttp.StatusRequestEntityTooLarge {
+		t.Errorf("diff of a long post: %d", code)
+	}
+}
+
+func TestModerationReasonForAuthor(t *testing.T) {
+	api := newTestApi(t, config.Default(), storage.NewMemory())
+
+	author := signup(t, api, "author@example.com")
+	other := signup(t, api, "other@example.com")
+
+	user := &types.UserInfo{Email: "author@example.com", Name: "author"}
+	moderator := &types.UserInfo{Email: "mod@example.com", Name: "mod"}
+
+	id, err := api.post.CreatePost(types.NewPostReq{Name: "post"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.moderation.moderate(id, types.ModerationApprove, "", moderator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.moderation.moderate(id, types.ModerationUnapprove, "needs sources", moderator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{"/api/v1/post?id=" + strconv.Itoa(id), "/api/v1/post/pending"} {
+		resp := author.do("GET", uri, "")
+		if resp.StatusCode() != fasthttp.StatusOK || !strings.Contains(string(resp.Body()), "needs sources") {
+			t.Errorf("author: %s %d %s", uri, resp.StatusCode(), resp.Body())
+		}
+	}
+
+	resp := other.do("GET", "/api/v1/post?id="+strconv.Itoa(id), "")
+	if resp.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("other user opened a pending post: %d %s", resp.StatusCode(), resp.Body())
+	}
+	resp = other.do("GET", "/api/v1/post/pending", "")
+	if resp.StatusCode() != fasthttp.StatusOK || strings.Contains(string(resp.Body()), "needs sources") {
+		t.Errorf("pending posts of another user: %d %s", resp.StatusCode(), resp.Body())
+	}
+
+	_, err = api.moderation.moderate(id, types.ModerationApprove, "", moderator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = author.do("GET", "/api/v1/post?id="+strconv.Itoa(id), "")
+	if resp.StatusCode() != fasthttp.StatusOK || strings.Contains(string(resp.Body()), `"moderation"`) {
+		t.Errorf("published post: %d %s", resp.StatusCode(), resp.Body())
+	}
+}
+
+func TestCommentsOfDeletedPost(t *testing.T) {
+	api := newTestApi(t, config.Default(), storage.NewMemory())
+	anonymous := &testClient{t: t, api: api}
+
+	user := &types.UserInfo{Email: "author@example.com", Name: "author"}
+
+	id, err := api.post.CreatePost(types.NewPostReq{Name: "post"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "/api/v1/comments?id=" + strconv.Itoa(id)
+
+	if code := anonymous.do("GET", uri, "").StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("comments of a post: %d", code)
+	}
+
+	err = api.post.Delete(id, user.Email, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tree := range []string{"", "&tree=true"} {
+		if code := anonymous.do("GET", uri+tree, "").StatusCode(); code != fasthttp.StatusNotFound {
+			t.Errorf("comments of a deleted post: %s %d", tree, code)
+		}
+	}
+
+	err = api.post.Restore(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := anonymous.do("GET", uri, "").StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("comments of a restored post: %d", code)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	db := storage.NewMemory()
+
+	cfg := config.Default()
+	cfg.TwoFactorRoles = nil
+	api := newTestApi(t, cfg, db)
+
+	admin := signup(t, api, "admin@example.com")
+	user := signup(t, api, "user@example.com")
+
+	grant := func(role string, grant bool) int {
+		body := fmt.Sprintf(`{"email":"user@example.com","role":%q,"grant":%t}`, role, grant)
+		return admin.do("POST", "/api/v1/adm/roles", body).StatusCode()
+	}
+
+	if code := grant(types.RoleModerator, true); code != fasthttp.StatusForbidden {
+		t.Fatalf("user without the admin role granted a role: %d", code)
+	}
+
+	// the first admin comes from the config
+	cfg = config.Default()
+	cfg.TwoFactorRoles = nil
+	cfg.AdminEmails = []string{"admin@example.com", "nobody@example.com"}
+	api = newTestApi(t, cfg, db)
+	admin.api, user.api = api, api
+
+	queue := func() int {
+		return user.do("GET", "/api/v1/adm/queue", "").StatusCode()
+	}
+
+	if code := queue(); code != fasthttp.StatusForbidden {
+		t.Errorf("user without the moderator role: %d", code)
+	}
+
+	if code := grant(types.RoleModerator, true); code != fasthttp.StatusOK {
+		t.Fatalf("grant: %d", code)
+	}
+	if code := queue(); code != fasthttp.StatusOK {
+		t.Errorf("moderator: %d", code)
+	}
+
+	if code := grant("owner", true); code != fasthttp.StatusBadRequest {
+		t.Errorf("unknown role: %d", code)
+	}
+
+	if code := grant(types.RoleModerator, false); code != fasthttp.StatusOK {
+		t.Fatalf("revoke: %d", code)
+	}
+	if code := queue(); code != fasthttp.StatusForbidden {
+		t.Errorf("revoked moderator: %d", code)
+	}
+
+	// admin needs a second factor by default
+	api = newTestApi(t, config.Default(), db)
+	admin.api = api
+
+	resp := admin.do("GET", "/api/v1/adm/audit", "")
+	if resp.StatusCode() != fasthttp.StatusForbidden || string(resp.Body()) != ErrTwoFactorRequired.Error() {
+		t.Errorf("admin without a second factor: %d %s", resp.StatusCode(), resp.Body())
+	}
+
+	info, err := api.auth.UserInfo("admin@example.com")
+	if err != nil || !info.HasRole(types.RoleAdmin) {
+		t.Errorf("admin role is not kept: %+v %v", info, err)
+	}
+}
+
+func TestModeratorWithoutSecondFactor(t *testing.T) {
+	api := newTestApi(t, config.Default(), storage.NewMemory())
+
+	admin := signup(t, api, "admin@example.com")
+	signup(t, api, "author@example.com")
+
+	err := api.auth.SetRole("admin@example.com", types.RoleAdmin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verified, so the edit reaches the role check
+	err = api.auth.db.Update(func(tx storage.Tx) error {
+		user, err := api.auth.readUser(tx, "admin@example.com")
+		if err != nil {
+			return err
+		}
+		user.Unverified = false
+		return api.auth.writeUser(tx, user)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := &types.UserInfo{Email: "author@example.com", Name: "author"}
+
+	postId, err := api.post.CreatePost(types.NewPostReq{Name: "post"}, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.post.Validate(postId, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commentId, err := api.comments.NewId(postId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.comments.Consume(postId, types.Comment{Id: commentId, UserName: author.Email, Content: "comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// admin is in TwoFactorRoles by default, without a second factor the
+	// admin is a plain user
+	for _, req := range []struct{ method, uri, body string }{
+		{"DELETE", "/api/v1/comments/" + strconv.Itoa(commentId), ""},
+		{"PUT", "/api/v1/comments/" + strconv.Itoa(commentId), `{"content":"edited"}`},
+		{"PUT", "/api/v1/post/" + strconv.Itoa(postId), `{"name":"edited"}`},
+		{"DELETE", "/api/v1/post/" + strconv.Itoa(postId), ""},
+		{"POST", "/api/v1/adm/moderate", fmt.Sprintf(`{"ids":[%d],"action":"unapprove"}`, postId)},
+		{"POST", "/api/v1/adm/valid?id=" + strconv.Itoa(postId), ""},
+	} {
+		if code := admin.do(req.method, req.uri, req.body).StatusCode(); code != fasthttp.StatusForbidden {
+			t.Errorf("%s %s: %d", req.method, req.uri, code)
+		}
+	}
+
+	if !api.post.isValidPost(postId) {
+		t.Error("post is hidden")
+	}
+}
@@ -4,16 +4,30 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/TokDenis/micro-blog/types"
-	"os"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"net/mail"
+	"net/url"
+	"strings"
 )
 
 type Auth struct {
+	db         storage.Storage
+	mailer     Mailer
+	mailTokens *MailTokens
+	// publicURL of the site, links in mails point there
+	publicURL string
 }
 
-func NewAuth() *Auth {
-	os.MkdirAll("db/users/", os.ModePerm)
-	return &Auth{}
+func NewAuth(db storage.Storage, mailer Mailer, mailTokens *MailTokens, publicURL string) *Auth {
+	return &Auth{
+		db:         db,
+		mailer:     mailer,
+		mailTokens: mailTokens,
+		publicURL:  strings.TrimSuffix(publicURL, "/"),
+	}
 }
 
 // Signup - registration in blog
@@ -23,34 +37,47 @@ func (a *Auth) Signup(req types.NewUserReq) error {
 		return err
 	}
 
-	f, err := os.OpenFile("db/users/"+req.Email, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	hash, err := hashPassword(req.Password)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-
 	b, err := json.Marshal(types.User{
-		Email:    req.Email,
-		Password: req.Password,
-		Name:     req.Name,
+		Email:      req.Email,
+		Password:   hash,
+		Name:       req.Name,
+		Roles:      types.DefaultRoles,
+		Unverified: true,
 	})
+	if err != nil {
+		return err
+	}
 
-	_, err = f.Write(b)
+	err = a.db.Write(storage.Users, req.Email, b)
 	if err != nil {
 		return err
 	}
 
+	// the user can ask for another mail
+	err = a.SendVerification(req.Email)
+	if err != nil {
+		log.Error().Err(err).Str("email", req.Email).Msg("send verification mail")
+	}
+
 	return nil
 }
 
 func (a *Auth) checkInfoCorrection(req *types.NewUserReq) error {
-	// check that password was hashed
-	if len(req.Password) != sha256.BlockSize {
-		return ErrIncorrectPassword
+	err := checkEmail(req.Email)
+	if err != nil {
+		return err
+	}
+	err = checkClientHash(req.Password)
+	if err != nil {
+		return err
 	}
 	// check is user already exist
-	if _, err := os.Open("db/users/" + req.Email); err == nil {
+	if _, err := a.db.Read(storage.Users, req.Email); err == nil {
 		return ErrUserExist
 	}
 
@@ -58,7 +85,7 @@ func (a *Auth) checkInfoCorrection(req *types.NewUserReq) error {
 }
 
 func (a *Auth) Sigin(email, password string) (*types.User, error) {
-	b, err := os.ReadFile("db/users/" + email)
+	b, err := a.db.Read(storage.Users, email)
 	if err != nil {
 		return nil, err
 	}
@@ -69,15 +96,75 @@ func (a *Auth) Sigin(email, password string) (*types.User, error) {
 		return nil, err
 	}
 
-	if user.Password != password {
+	// created by the OpenID Connect provider
+	if user.Password == "" {
 		return nil, ErrUnauthorized
 	}
 
+	ok, rehash, err := checkPassword(user.Password, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	if rehash {
+		err = a.rehashPassword(email, user.Password, password)
+		if err != nil {
+			log.Error().Err(err).Str("email", email).Msg("rehash password")
+		}
+	}
+
 	return &user, nil
 }
 
+// checkEmail a bare RFC 5322 address, without a display name. Slashes
+// are valid in an address but not in a storage key.
+func checkEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || strings.ContainsAny(email, "/\\") {
+		return ErrIncorrectEmail
+	}
+	return nil
+}
+
+// checkClientHash check that password was hashed on the client, the server hashes it again
+func checkClientHash(password string) error {
+	if len(password) != sha256.BlockSize {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+// rehashPassword replaces the legacy or outdated hash old. The user is
+// read again in the transaction, a password changed since the check is
+// kept.
+func (a *Auth) rehashPassword(email, old, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if user.Password != old {
+			return nil
+		}
+
+		user.Password = hash
+
+		return a.writeUser(tx, user)
+	})
+}
+
 func (a *Auth) UserInfo(email string) (*types.UserInfo, error) {
-	b, err := os.ReadFile("db/users/" + email)
+	b, err := a.db.Read(storage.Users, email)
 	if err != nil {
 		return nil, err
 	}
@@ -89,10 +176,254 @@ func (a *Auth) UserInfo(email string) (*types.UserInfo, error) {
 		return nil, err
 	}
 
+	if user.Roles == nil {
+		user.Roles = types.DefaultRoles
+	}
+
 	return &user, nil
 }
 
+// SetRole grants or revokes the role
+func (a *Auth) SetRole(email, role string, grant bool) error {
+	known := false
+	for _, r := range types.Roles {
+		known = known || r == role
+	}
+	if !known {
+		return ErrUnknownRole
+	}
+
+	return a.db.Update(func(tx storage.Tx) error {
+		b, err := tx.Read(storage.Users, email)
+		if err != nil {
+			return err
+		}
+
+		var user types.User
+
+		err = json.Unmarshal(b, &user)
+		if err != nil {
+			return err
+		}
+
+		roles := user.Roles
+		if roles == nil {
+			roles = types.DefaultRoles
+		}
+
+		user.Roles = []string{}
+		for _, r := range roles {
+			if r != role {
+				user.Roles = append(user.Roles, r)
+			}
+		}
+		if grant {
+			user.Roles = append(user.Roles, role)
+		}
+
+		b, err = json.Marshal(&user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Write(storage.Users, email, b)
+	})
+}
+
+// SendVerification mails a link that confirms the email
+func (a *Auth) SendVerification(email string) error {
+	user, err := a.readUser(a.db, email)
+	if err != nil {
+		return err
+	}
+
+	if !user.Unverified {
+		return ErrAlreadyVerified
+	}
+
+	token, err := a.mailTokens.Make(MailVerify, email, "")
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(email, "Confirm your email",
+		"Open the link to confirm your email:\n\n"+a.publicURL+"/verify?token="+url.QueryEscape(token))
+}
+
+// Verify confirms the email of the token
+func (a *Auth) Verify(token string) error {
+	email, _, err := a.mailTokens.Parse(MailVerify, token)
+	if err != nil {
+		return err
+	}
+
+	return a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if !user.Unverified {
+			return ErrAlreadyVerified
+		}
+
+		user.Unverified = false
+
+		return a.writeUser(tx, user)
+	})
+}
+
+// RequestReset mails a password reset link, nothing is sent to an
+// unknown email
+func (a *Auth) RequestReset(email string) error {
+	user, err := a.readUser(a.db, email)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := a.mailTokens.Make(MailReset, email, passwordStamp(user.Password))
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(email, "Reset your password",
+		"Open the link to set a new password:\n\n"+a.publicURL+"/reset?token="+url.QueryEscape(token)+
+			"\n\nIgnore this mail if you did not ask for it.")
+}
+
+// ResetPassword sets the password, the token stops working after that.
+// Following the link proves the email, so the user becomes verified.
+func (a *Auth) ResetPassword(token, password string) (email string, err error) {
+	err = checkClientHash(password)
+	if err != nil {
+		return "", err
+	}
+
+	email, stamp, err := a.mailTokens.Parse(MailReset, token)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if passwordStamp(user.Password) != stamp {
+			return ErrMailTokenUsed
+		}
+
+		user.Password = hash
+		user.Unverified = false
+
+		return a.writeUser(tx, user)
+	})
+
+	return email, err
+}
+
+// OIDCUser user of the provider claims, found by the verified email or
+// created without a password. The first login links the subject, later
+// ones must come with the same subject.
+func (a *Auth) OIDCUser(claims *OIDCClaims) (user *types.User, err error) {
+	if !claims.EmailVerified {
+		return nil, ErrOIDCEmailNotVerified
+	}
+
+	err = checkEmail(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.db.Update(func(tx storage.Tx) error {
+		user, err = a.readUser(tx, claims.Email)
+		if errors.Is(err, fs.ErrNotExist) {
+			name := claims.Name
+			if name == "" {
+				name = strings.Split(claims.Email, "@")[0]
+			}
+
+			user = &types.User{
+				Email:       claims.Email,
+				Name:        name,
+				Roles:       types.DefaultRoles,
+				OIDCSubject: claims.Subject,
+			}
+
+			log.Info().Str("email", claims.Email).Msg("user created by oidc")
+
+			return a.writeUser(tx, user)
+		}
+		if err != nil {
+			return err
+		}
+
+		if user.OIDCSubject != "" && user.OIDCSubject != claims.Subject {
+			return ErrOIDCSubjectMismatch
+		}
+
+		// linked already, nothing to write
+		if user.OIDCSubject == claims.Subject && !user.Unverified {
+			return nil
+		}
+
+		if user.OIDCSubject == "" {
+			log.Info().Str("email", claims.Email).Msg("user linked to oidc")
+		}
+
+		user.OIDCSubject = claims.Subject
+		// the provider checked the email
+		user.Unverified = false
+
+		return a.writeUser(tx, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (a *Auth) readUser(tx storage.Tx, email string) (*types.User, error) {
+	b, err := tx.Read(storage.Users, email)
+	if err != nil {
+		return nil, err
+	}
+
+	var user types.User
+
+	err = json.Unmarshal(b, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (a *Auth) writeUser(tx storage.Tx, user *types.User) error {
+	b, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.Users, user.Email, b)
+}
+
 var ErrIncorrectPassword = errors.New("incorrect password")
 var ErrIncorrectEmail = errors.New("incorrect email")
 var ErrUserExist = errors.New("exist")
 var ErrUnauthorized = errors.New("unauthorized")
+var ErrUnknownRole = errors.New("unknown role")
+var ErrAlreadyVerified = errors.New("email is already verified")
+var ErrMailTokenUsed = errors.New("token is already used")
+var ErrOIDCEmailNotVerified = errors.New("email is not verified by the provider")
+var ErrOIDCSubjectMismatch = errors.New("email is linked to another provider account")
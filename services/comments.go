@@ -2,138 +2,631 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/TokDenis/micro-blog/types"
-	"io"
-	"os"
+	"github.com/rs/zerolog/log"
+	"io/fs"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Comments struct {
+	db           storage.Storage
+	wal          *CommentsWal
+	editWindow   time.Duration
 	commentsChan chan types.Comment
 	buffer       map[int][]*types.Comment // [post_id]
 	bufferM      sync.RWMutex
+	index        commentsIndex
+	indexM       sync.Mutex
+	closeChan    chan chan error
 }
 
-const CommentsPath = "db/comments/"
-
-func NewCommentsService() *Comments {
-	os.MkdirAll(CommentsPath, os.ModePerm)
-
+func NewCommentsService(db storage.Storage, wal *CommentsWal, editWindow time.Duration) (*Comments, error) {
 	c := Comments{
+		db:           db,
+		wal:          wal,
+		editWindow:   editWindow,
 		commentsChan: make(chan types.Comment, 100),
 		buffer:       make(map[int][]*types.Comment),
+		index:        make(commentsIndex),
+		closeChan:    make(chan chan error),
+	}
+
+	err := c.migrateCommentIds()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.migrateCommentRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	// comments acknowledged before a crash or a failed shutdown
+	replayed, err := wal.Replay(func(postId int, msg types.Comment) {
+		c.buffer[postId] = append(c.buffer[postId], &msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the post was purged before its comments left the wal
+	for postId := range c.buffer {
+		_, err = db.Read(storage.Posts, strconv.Itoa(postId))
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Int("post", postId).Msg("skip replayed comments of a missing post")
+			delete(c.buffer, postId)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// nothing left to merge, sealed segments are stored or skipped
+	if len(c.buffer) == 0 {
+		err = wal.Truncate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// logged by a version without stable ids
+	for postId, comments := range c.buffer {
+		for _, comment := range comments {
+			if comment.Id != 0 {
+				continue
+			}
+			comment.Id, err = c.NewId(postId, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if replayed != 0 {
+		log.Info().Msgf("replayed %d comments from wal", replayed)
+		metrics.Add(MetricCommentsReplayed, int64(replayed))
 	}
 
 	go c.serv()
 
-	return &c
+	return &c, nil
+}
+
+const commentsSequence = "comments"
+
+// NewId allocates a comment id, ids are global and never reused.
+// parentId is the comment replied to, 0 for a top level comment.
+func (c *Comments) NewId(postId, parentId int) (id int, err error) {
+	err = c.db.Update(func(tx storage.Tx) error {
+		if parentId != 0 {
+			parentPostId, err := commentPost(tx, parentId)
+			if err != nil {
+				return err
+			}
+			if parentPostId != postId {
+				return ErrParentNotFound
+			}
+		}
+
+		id, err = nextSequence(tx, commentsSequence)
+		if err != nil {
+			return err
+		}
+
+		return tx.Write(storage.CommentIndex, strconv.Itoa(id), []byte(strconv.Itoa(postId)))
+	})
+
+	return id, err
 }
 
-func (c *Comments) Consume(postId int, msg types.Comment) {
+// migrateCommentIds numbers comments stored before ids were allocated at
+// creation, it runs once while the comments sequence does not exist
+func (c *Comments) migrateCommentIds() error {
+	return c.db.Update(func(tx storage.Tx) error {
+		_, err := tx.Read(storage.Sequences, commentsSequence)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		keys, err := tx.Keys(storage.Comments)
+		if err != nil {
+			return err
+		}
+
+		var postIds []int
+		for _, key := range keys {
+			postId, err := strconv.Atoi(key)
+			if err != nil {
+				continue
+			}
+			postIds = append(postIds, postId)
+		}
+
+		sort.Ints(postIds)
+
+		var last int
+
+		for _, postId := range postIds {
+			b, err := tx.Read(storage.Comments, strconv.Itoa(postId))
+			if err != nil {
+				return err
+			}
+
+			var comments []*types.Comment
+
+			err = json.Unmarshal(b, &comments)
+			if err != nil {
+				return err
+			}
+
+			sort.SliceStable(comments, func(i, j int) bool { return comments[i].Created.Before(comments[j].Created) })
+
+			for _, comment := range comments {
+				last++
+				comment.Id = last
+
+				err = tx.Write(storage.CommentIndex, strconv.Itoa(last), []byte(strconv.Itoa(postId)))
+				if err != nil {
+					return err
+				}
+			}
+
+			b, err = json.Marshal(&comments)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Write(storage.Comments, strconv.Itoa(postId), b)
+			if err != nil {
+				return err
+			}
+		}
+
+		if last != 0 {
+			log.Info().Msgf("numbered %d stored comments", last)
+		}
+
+		return setSequence(tx, commentsSequence, last)
+	})
+}
+
+// migrateCommentRecords splits json arrays of post comments into records
+func (c *Comments) migrateCommentRecords() error {
+	keys, err := c.db.Keys(storage.Comments)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = c.db.Update(func(tx storage.Tx) error {
+			b, err := tx.Read(storage.Comments, key)
+			if err != nil {
+				return err
+			}
+
+			var comments []*types.Comment
+
+			err = json.Unmarshal(b, &comments)
+			if err != nil {
+				return err
+			}
+
+			ids := make([]byte, 0, len(comments)*8)
+
+			for _, comment := range comments {
+				err = writeComment(tx, comment)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, Uint64ToByte(uint64(comment.Id))...)
+			}
+
+			// written whole, so a retry after a crash gives the same index
+			err = tx.Write(storage.PostComments, key, ids)
+			if err != nil {
+				return err
+			}
+
+			return tx.Delete(storage.Comments, key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) != 0 {
+		log.Info().Msgf("moved comments of %d posts to records", len(keys))
+	}
+
+	return nil
+}
+
+// Consume returns after the comment is written to the wal
+func (c *Comments) Consume(postId int, msg types.Comment) error {
 	c.bufferM.Lock()
+	defer c.bufferM.Unlock()
+
+	err := c.wal.Append(postId, msg)
+	if err != nil {
+		metrics.Add(MetricCommentsWalErrors, 1)
+		return err
+	}
+
 	c.buffer[postId] = append(c.buffer[postId], &msg)
-	c.bufferM.Unlock()
+
+	return nil
 }
 
-func (c *Comments) GetComments(postId int) ([]*types.Comment, error) {
-	f, err := os.OpenFile(CommentsPath+"/"+strconv.Itoa(postId), os.O_RDONLY, os.ModePerm)
+// readComment reads a stored comment
+func readComment(tx storage.Tx, id int) (*types.Comment, error) {
+	b, err := tx.Read(storage.CommentRecords, strconv.Itoa(id))
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrCommentNotFound
+		}
 		return nil, err
 	}
-	defer f.Close()
 
-	b, err := io.ReadAll(f)
+	var comment types.Comment
+
+	err = json.Unmarshal(b, &comment)
 	if err != nil {
 		return nil, err
 	}
 
-	var comments []*types.Comment
+	return &comment, nil
+}
 
-	err = json.Unmarshal(b, &comments)
+func writeComment(tx storage.Tx, comment *types.Comment) error {
+	b, err := json.Marshal(comment)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	res := comments[:0]
+	return tx.Write(storage.CommentRecords, strconv.Itoa(comment.Id), b)
+}
 
-	for _, comment := range comments {
-		if comment.IsDeleted {
-			continue
+// commentPost post id of the comment
+func commentPost(tx storage.Tx, id int) (int, error) {
+	b, err := tx.Read(storage.CommentIndex, strconv.Itoa(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, ErrCommentNotFound
 		}
-		res = append(res, comment)
+		return 0, err
 	}
 
-	return res, err
+	return strconv.Atoi(string(b))
 }
 
-func (c *Comments) AppendNewComments(postId int, newComments []*types.Comment) error {
-	if len(newComments) == 0 {
+// Edit replaces the content of a comment, the author can do it within
+// the edit window, a moderator at any time
+func (c *Comments) Edit(id int, email, content string, moderator bool) error {
+	return c.update(id, func(tx storage.Tx, comment *types.Comment) error {
+		if comment.UserName != email && !moderator {
+			return ErrForbidden
+		}
+
+		now := time.Now()
+		if comment.UserName == email && !moderator && now.Sub(comment.Created) > c.editWindow {
+			return ErrEditWindowClosed
+		}
+
+		comment.Revisions = append(comment.Revisions, types.CommentRevision{
+			Content:  comment.Content,
+			Replaced: now,
+		})
+		comment.Content = content
+		comment.Edited = &now
+
 		return nil
+	})
+}
+
+// Revisions contents of a comment replaced by edits, oldest first. Only
+// the author and moderators see them, listings leave them out.
+func (c *Comments) Revisions(id int, email string, moderator bool) ([]types.CommentRevision, error) {
+	comment, err := readComment(c.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if comment.UserName != email && !moderator {
+		return nil, ErrForbidden
 	}
 
-	f, err := os.OpenFile(CommentsPath+"/"+strconv.Itoa(postId), os.O_RDWR|os.O_CREATE, os.ModePerm)
+	return comment.Revisions, nil
+}
+
+// Delete hides a comment, it stays in storage. The author or a moderator
+// can do it.
+func (c *Comments) Delete(id int, email string, moderator bool) error {
+	return c.update(id, func(tx storage.Tx, comment *types.Comment) error {
+		if comment.UserName != email && !moderator {
+			return ErrForbidden
+		}
+
+		now := time.Now()
+		comment.IsDeleted = true
+		comment.Deleted = &now
+
+		return nil
+	})
+}
+
+// React adds or removes the reaction of the user, one per user
+func (c *Comments) React(id int, email string, add bool) error {
+	key := strconv.Itoa(id) + "-" + email
+
+	return c.update(id, func(tx storage.Tx, comment *types.Comment) error {
+		_, err := tx.Read(storage.CommentReactions, key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		reacted := err == nil
+
+		switch {
+		case add && !reacted:
+			comment.Reactions++
+			return tx.Write(storage.CommentReactions, key, []byte("1"))
+		case !add && reacted:
+			comment.Reactions--
+			return tx.Delete(storage.CommentReactions, key)
+		}
+
+		return nil
+	})
+}
+
+// update changes a stored not deleted comment
+func (c *Comments) update(id int, fn func(tx storage.Tx, comment *types.Comment) error) error {
+	postId, err := commentPost(c.db, id)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	b, err := io.ReadAll(f)
+	c.bufferM.Lock()
+	defer c.bufferM.Unlock()
+
+	// the comment may still wait for the flush
+	err = c.AppendNewComments(postId, c.buffer[postId])
 	if err != nil {
 		return err
 	}
+	delete(c.buffer, postId)
+
+	c.indexM.Lock()
+	defer c.indexM.Unlock()
 
-	if len(b) != 0 {
-		var oldComments []*types.Comment
+	var comment *types.Comment
 
-		err = json.Unmarshal(b, &oldComments)
+	err = c.db.Update(func(tx storage.Tx) error {
+		comment, err = readComment(tx, id)
 		if err != nil {
 			return err
 		}
 
-		newComments = append(newComments, oldComments...)
+		if comment.IsDeleted {
+			return ErrCommentNotFound
+		}
+
+		err = fn(tx, comment)
+		if err != nil {
+			return err
+		}
+
+		return writeComment(tx, comment)
+	})
+	if err != nil {
+		return err
 	}
 
-	sort.Slice(newComments, func(i, j int) bool { return newComments[i].Created.Before(newComments[j].Created) })
+	c.index.set(postId, comment)
+
+	return nil
+}
 
-	for i, comment := range newComments {
-		comment.Id = i
+// PurgePost deletes the comments of a post with their reactions. The post
+// must not get new comments, a comment consumed during the purge would be
+// stored after it. The flush empties the wal, a record it keeps because
+// another post failed to merge is skipped on replay.
+func (c *Comments) PurgePost(postId int) error {
+	// comments still in the buffer and the wal are stored first
+	err := c.flush()
+	if err != nil {
+		return err
 	}
 
-	b, err = json.Marshal(&newComments)
+	reactions, err := c.db.Keys(storage.CommentReactions)
 	if err != nil {
 		return err
 	}
 
-	err = f.Truncate(int64(len(b)))
+	c.bufferM.Lock()
+	defer c.bufferM.Unlock()
+
+	c.indexM.Lock()
+	defer c.indexM.Unlock()
+
+	err = c.db.Update(func(tx storage.Tx) error {
+		b, err := tx.Read(storage.PostComments, strconv.Itoa(postId))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		ids := make(map[string]bool)
+		for i := 0; i+8 <= len(b); i += 8 {
+			id := strconv.Itoa(int(ByteToUint64(b[i : i+8])))
+			ids[id] = true
+
+			err = deleteRecord(tx, storage.CommentRecords, id)
+			if err != nil {
+				return err
+			}
+
+			err = deleteRecord(tx, storage.CommentIndex, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		// key is <comment id>-<email>
+		for _, key := range reactions {
+			i := strings.Index(key, "-")
+			if i < 0 || !ids[key[:i]] {
+				continue
+			}
+
+			err = deleteRecord(tx, storage.CommentReactions, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(storage.PostComments, strconv.Itoa(postId))
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = f.WriteAt(b, 0)
+	delete(c.index, postId)
+
+	return nil
+}
+
+// AppendNewComments stores comments and adds them to the post index
+func (c *Comments) AppendNewComments(postId int, newComments []*types.Comment) error {
+	if len(newComments) == 0 {
+		return nil
+	}
+
+	c.indexM.Lock()
+	defer c.indexM.Unlock()
+
+	var appended []*types.Comment
+
+	err := c.db.Update(func(tx storage.Tx) error {
+		appended = appended[:0]
+
+		for _, comment := range newComments {
+			// replayed from the wal after it was merged, but before the wal was truncated
+			_, err := tx.Read(storage.CommentRecords, strconv.Itoa(comment.Id))
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			err = writeComment(tx, comment)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Append(storage.PostComments, strconv.Itoa(postId), Uint64ToByte(uint64(comment.Id)))
+			if err != nil {
+				return err
+			}
+
+			appended = append(appended, comment)
+		}
+
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	for _, comment := range appended {
+		c.index.set(postId, comment)
+	}
+
+	return nil
+}
+
+// Close stops the background flush and writes the buffered comments.
+// Consume must not be called after Close.
+func (c *Comments) Close() error {
+	done := make(chan error)
+	c.closeChan <- done
+	err := <-done
+
+	if walErr := c.wal.Close(); err == nil {
+		err = walErr
+	}
+
 	return err
 }
 
 func (c *Comments) serv() {
 	tic := time.NewTicker(time.Second)
+	defer tic.Stop()
+
 	for {
-		<-tic.C
-		c.bufferM.Lock()
-		for postId, comments := range c.buffer {
-			err := c.AppendNewComments(postId, comments)
-			if err != nil {
+		select {
+		case <-tic.C:
+			c.flush()
+		case done := <-c.closeChan:
+			done <- c.flush()
+			return
+		}
+	}
+}
 
-				continue
-			}
-			delete(c.buffer, postId)
+func (c *Comments) flush() (err error) {
+	c.bufferM.Lock()
+	defer c.bufferM.Unlock()
+
+	// update may have stored the buffer already, its records are still
+	// in the wal
+	if len(c.buffer) == 0 && c.wal.Size() == 0 {
+		return nil
+	}
+
+	// everything in the buffer is in sealed segments after this
+	err = c.wal.Seal()
+	if err != nil {
+		metrics.Add(MetricCommentsWalErrors, 1)
+		log.Error().Err(err).Msg("seal comments wal")
+		return err
+	}
+
+	for postId, comments := range c.buffer {
+		appendErr := c.AppendNewComments(postId, comments)
+		if appendErr != nil {
+			metrics.Add(MetricCommentsFlushErrors, 1)
+			log.Error().Err(appendErr).Int("post", postId).Msg("append comments")
+			err = appendErr
+			continue
 		}
-		c.bufferM.Unlock()
+		delete(c.buffer, postId)
 	}
 
+	// sealed segments are kept until the failed posts are merged too
+	if len(c.buffer) != 0 {
+		return err
+	}
+
+	err = c.wal.Truncate()
+	if err != nil {
+		metrics.Add(MetricCommentsWalErrors, 1)
+		log.Error().Err(err).Msg("truncate comments wal")
+	}
+
+	return err
 }
+
+var ErrCommentNotFound = errors.New("comment not found")
+var ErrParentNotFound = errors.New("parent comment not found")
+var ErrForbidden = errors.New("forbidden")
+var ErrEditWindowClosed = errors.New("edit window is closed")
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"io/fs"
+	"sort"
+	"strconv"
+)
+
+// commentMeta what listing needs to know about a comment without reading it
+type commentMeta struct {
+	id        int
+	parentId  int
+	reactions int
+	deleted   bool
+}
+
+// commentsIndex metas of the comments of a post sorted by id, a post is
+// loaded on the first listing and kept up to date after that
+type commentsIndex map[int][]commentMeta // [post_id]
+
+const (
+	CommentsOldest    = "oldest"
+	CommentsNewest    = "newest"
+	CommentsReactions = "reactions"
+)
+
+// set updates the comment of a loaded post
+func (ci commentsIndex) set(postId int, comment *types.Comment) {
+	metas, ok := ci[postId]
+	if !ok {
+		return
+	}
+
+	meta := commentMeta{
+		id:        comment.Id,
+		parentId:  comment.ParentId,
+		reactions: comment.Reactions,
+		deleted:   comment.IsDeleted,
+	}
+
+	i := sort.Search(len(metas), func(i int) bool { return metas[i].id >= comment.Id })
+	if i < len(metas) && metas[i].id == comment.Id {
+		metas[i] = meta
+		return
+	}
+
+	metas = append(metas, commentMeta{})
+	copy(metas[i+1:], metas[i:])
+	metas[i] = meta
+	ci[postId] = metas
+}
+
+// metas returns a copy of the post comments metas
+func (c *Comments) metas(postId int) ([]commentMeta, error) {
+	c.indexM.Lock()
+	defer c.indexM.Unlock()
+
+	metas, ok := c.index[postId]
+	if !ok {
+		var err error
+		metas, err = c.loadMetas(postId)
+		if err != nil {
+			return nil, err
+		}
+		c.index[postId] = metas
+	}
+
+	return append([]commentMeta(nil), metas...), nil
+}
+
+func (c *Comments) loadMetas(postId int) ([]commentMeta, error) {
+	b, err := c.db.Read(storage.PostComments, strconv.Itoa(postId))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	metas := make([]commentMeta, 0, len(b)/8)
+
+	for i := 0; i+8 <= len(b); i += 8 {
+		comment, err := readComment(c.db, int(ByteToUint64(b[i:i+8])))
+		if err != nil {
+			return nil, err
+		}
+
+		metas = append(metas, commentMeta{
+			id:        comment.Id,
+			parentId:  comment.ParentId,
+			reactions: comment.Reactions,
+			deleted:   comment.IsDeleted,
+		})
+	}
+
+	sort.Slice(metas, func(i, j int) bool { return metas[i].id < metas[j].id })
+
+	return metas, nil
+}
+
+// Page not deleted comments of the post in the order. after is the id of
+// the last comment of the previous page, 0 for the first page. total is
+// the count of all not deleted comments.
+func (c *Comments) Page(postId int, order string, after, limit int) (comments []*types.Comment, total int, err error) {
+	metas, err := c.metas(postId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	visible := metas[:0]
+	for _, meta := range metas {
+		if !meta.deleted {
+			visible = append(visible, meta)
+		}
+	}
+
+	switch order {
+	case CommentsOldest:
+	case CommentsNewest:
+		sort.Slice(visible, func(i, j int) bool { return visible[i].id > visible[j].id })
+	case CommentsReactions:
+		sort.SliceStable(visible, func(i, j int) bool { return visible[i].reactions > visible[j].reactions })
+	default:
+		return nil, 0, ErrUnknownOrder
+	}
+
+	from := 0
+	if after != 0 {
+		from = -1
+		for i, meta := range visible {
+			if meta.id == after {
+				from = i + 1
+				break
+			}
+		}
+		// the cursor comment is deleted, ids still tell where to continue
+		if from == -1 {
+			if order == CommentsReactions {
+				return nil, 0, ErrUnknownCursor
+			}
+			from = sort.Search(len(visible), func(i int) bool {
+				if order == CommentsNewest {
+					return visible[i].id < after
+				}
+				return visible[i].id > after
+			})
+		}
+	}
+
+	for i := from; i < len(visible) && len(comments) < limit; i++ {
+		comment, err := readComment(c.db, visible[i].id)
+		if err != nil {
+			return nil, 0, err
+		}
+		// earlier contents are for the author, see Revisions
+		comment.Revisions = nil
+		comments = append(comments, comment)
+	}
+
+	return comments, len(visible), nil
+}
+
+var ErrUnknownOrder = errors.New("unknown order")
+var ErrUnknownCursor = errors.New("unknown cursor")
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"github.com/TokDenis/micro-blog/types"
+)
+
+// GetTree replies of threadId (0 for top level comments) as a tree.
+// page and limit select the first level, deeper levels show up to limit
+// replies each and nothing below maxDepth. Only comments in the tree are
+// read from storage.
+func (c *Comments) GetTree(postId, threadId, maxDepth, page, limit int) ([]*types.CommentNode, error) {
+	metas, err := c.metas(postId)
+	if err != nil {
+		return nil, err
+	}
+
+	// metas are sorted by id, so replies are in posting order
+	replies := make(map[int][]commentMeta)
+	for _, meta := range metas {
+		replies[meta.parentId] = append(replies[meta.parentId], meta)
+	}
+
+	visible := make(map[int]bool)
+	markVisible(replies, 0, visible)
+
+	var thread []commentMeta
+	for _, meta := range replies[threadId] {
+		if visible[meta.id] {
+			thread = append(thread, meta)
+		}
+	}
+
+	from := page * limit
+	if from >= len(thread) {
+		return nil, nil
+	}
+
+	to := from + limit
+	if to > len(thread) {
+		to = len(thread)
+	}
+
+	nodes := make([]*types.CommentNode, 0, to-from)
+	for _, meta := range thread[from:to] {
+		node, err := c.buildNode(replies, visible, meta, 1, maxDepth, limit)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+func (c *Comments) buildNode(replies map[int][]commentMeta, visible map[int]bool, meta commentMeta, depth, maxDepth, limit int) (*types.CommentNode, error) {
+	comment, err := readComment(c.db, meta.id)
+	if err != nil {
+		return nil, err
+	}
+
+	// earlier contents are for the author, see Revisions
+	comment.Revisions = nil
+
+	node := &types.CommentNode{Comment: comment}
+
+	if comment.IsDeleted {
+		// kept only to hold its replies together
+		node.Comment = &types.Comment{
+			Id:        comment.Id,
+			ParentId:  comment.ParentId,
+			IsDeleted: true,
+			Created:   comment.Created,
+			Deleted:   comment.Deleted,
+		}
+	}
+
+	for _, reply := range replies[meta.id] {
+		if !visible[reply.id] {
+			continue
+		}
+
+		if depth >= maxDepth || len(node.Replies) == limit {
+			node.MoreReplies++
+			continue
+		}
+
+		replyNode, err := c.buildNode(replies, visible, reply, depth+1, maxDepth, limit)
+		if err != nil {
+			return nil, err
+		}
+		node.Replies = append(node.Replies, replyNode)
+	}
+
+	return node, nil
+}
+
+// markVisible a comment is shown if it is not deleted or has a shown reply
+func markVisible(replies map[int][]commentMeta, parentId int, visible map[int]bool) (shown bool) {
+	for _, meta := range replies[parentId] {
+		if markVisible(replies, meta.id, visible) || !meta.deleted {
+			visible[meta.id] = true
+			shown = true
+		}
+	}
+	return shown
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CommentsWal write-ahead log of comments that are not merged into storage
+// yet. Comments are appended to the current segment, a flush seals it and
+// sealed segments are removed once everything in them is merged.
+type CommentsWal struct {
+	dir  string
+	seq  int
+	size int
+	f    *os.File
+	m    sync.Mutex
+}
+
+type walRecord struct {
+	PostId  int           `json:"post_id"`
+	Comment types.Comment `json:"comment"`
+}
+
+const walExt = ".wal"
+
+func NewCommentsWal(dir string) (*CommentsWal, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &CommentsWal{dir: dir}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) != 0 {
+		w.seq = segments[len(segments)-1]
+	}
+
+	err = w.open(w.seq + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Append returns after the record is on disk
+func (w *CommentsWal) Append(postId int, comment types.Comment) error {
+	b, err := json.Marshal(walRecord{PostId: postId, Comment: comment})
+	if err != nil {
+		return err
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	_, err = w.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = w.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	w.size += len(b) + 1
+
+	return nil
+}
+
+// Seal starts a new segment if the current one is not empty
+func (w *CommentsWal) Seal() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.size == 0 {
+		return nil
+	}
+
+	err := w.f.Close()
+	if err != nil {
+		return err
+	}
+
+	return w.open(w.seq + 1)
+}
+
+// Size bytes in the current segment
+func (w *CommentsWal) Size() int {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.size
+}
+
+// Truncate removes all sealed segments
+func (w *CommentsWal) Truncate() error {
+	w.m.Lock()
+	current := w.seq
+	w.m.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq >= current {
+			continue
+		}
+
+		err = os.Remove(w.path(seq))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay reads records of sealed segments. A torn record at the end of a
+// segment is a crash during Append, it was never acknowledged and is skipped.
+func (w *CommentsWal) Replay(fn func(postId int, comment types.Comment)) (count int, err error) {
+	w.m.Lock()
+	current := w.seq
+	w.m.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, seq := range segments {
+		if seq >= current {
+			continue
+		}
+
+		f, err := os.Open(w.path(seq))
+		if err != nil {
+			return count, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<24)
+
+		for scanner.Scan() {
+			var rec walRecord
+			err = json.Unmarshal(scanner.Bytes(), &rec)
+			if err != nil {
+				log.Warn().Err(err).Str("segment", w.path(seq)).Msg("skip torn comments wal record")
+				continue
+			}
+
+			fn(rec.PostId, rec.Comment)
+			count++
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+func (w *CommentsWal) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.f.Close()
+}
+
+func (w *CommentsWal) open(seq int) error {
+	f, err := os.OpenFile(w.path(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// make the new segment itself durable
+	d, err := os.Open(w.dir)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.seq = seq
+	w.size = 0
+
+	return nil
+}
+
+func (w *CommentsWal) path(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walExt))
+}
+
+func (w *CommentsWal) segments() ([]int, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), walExt) {
+			continue
+		}
+
+		seq, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), walExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
@@ -0,0 +1,544 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCommentsWalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := NewCommentsWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		err = w.Append(1, types.Comment{UserName: "user@example.com", Content: content, Created: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crash in the middle of the third append
+	f, err := os.OpenFile(w.path(w.seq), os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte(`{"post_id":1,"comm`))
+	f.Close()
+
+	w, err = NewCommentsWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := storage.NewMemory()
+
+	// comments of a missing post are not replayed
+	err = db.Write(storage.Posts, "1", []byte(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, _, err := c.Page(1, CommentsOldest, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].Content != "first" || comments[1].Content != "second" {
+		t.Errorf("unexpected comments %+v", comments)
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("merged segments are not removed: %v", segments)
+	}
+}
+
+func TestStableCommentIds(t *testing.T) {
+	db := storage.NewMemory()
+
+	// stored by a version that renumbered comments of every post from 0
+	err := db.Write(storage.Comments, "0", []byte(`[{"id":0,"content":"a"},{"id":1,"content":"b"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Write(storage.Comments, "1", []byte(`[{"id":0,"content":"c"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, err := c.NewId(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Errorf("unexpected new id %d", id)
+	}
+
+	comment := &types.Comment{Id: id, Content: "d"}
+
+	// the second append is a wal replay of an already merged comment
+	for i := 0; i < 2; i++ {
+		err = c.AppendNewComments(1, []*types.Comment{comment})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comments, _, err := c.Page(1, CommentsOldest, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].Id != 3 || comments[1].Id != 4 {
+		t.Errorf("unexpected comments %+v", comments)
+	}
+}
+
+func TestCommentsTree(t *testing.T) {
+	db := storage.NewMemory()
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 1
+	// ├ 2 (deleted)
+	// │ └ 4
+	// └ 3
+	//   └ 5
+	//     └ 6
+	for _, parentId := range []int{0, 1, 1, 2, 3, 5} {
+		id, err := c.NewId(1, parentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Consume(1, types.Comment{Id: id, ParentId: parentId, UserName: "user@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = c.NewId(2, 1)
+	if err != ErrParentNotFound {
+		t.Errorf("reply to a comment of another post, got %v", err)
+	}
+
+	err = c.Delete(2, "user@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := c.GetTree(1, 0, 3, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 || tree[0].Id != 1 {
+		t.Fatalf("unexpected roots %+v", tree)
+	}
+
+	root := tree[0]
+	if len(root.Replies) != 1 || root.MoreReplies != 1 {
+		t.Fatalf("replies are not limited: %+v", root)
+	}
+	if !root.Replies[0].IsDeleted || len(root.Replies[0].Replies) != 1 {
+		t.Errorf("deleted comment must hold its replies: %+v", root.Replies[0])
+	}
+
+	tree, err = c.GetTree(1, 3, 3, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 1 || tree[0].Id != 5 || len(tree[0].Replies) != 1 || tree[0].Replies[0].Id != 6 {
+		t.Errorf("unexpected thread %+v", tree)
+	}
+
+	tree, err = c.GetTree(1, 0, 2, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree[0].Replies[1].Id != 3 || tree[0].Replies[1].MoreReplies != 1 {
+		t.Errorf("depth is not limited: %+v", tree[0].Replies[1])
+	}
+}
+
+func TestCommentsPage(t *testing.T) {
+	db := storage.NewMemory()
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		id, err := c.NewId(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Consume(1, types.Comment{Id: id, UserName: "user@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		err = c.React(4, email, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.React(2, "a@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Delete(3, "user@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		order string
+		after int
+		want  string
+	}{
+		{CommentsOldest, 0, "[1 2]"},
+		{CommentsOldest, 2, "[4 5]"},
+		{CommentsOldest, 3, "[4 5]"},
+		{CommentsNewest, 0, "[5 4]"},
+		{CommentsNewest, 4, "[2 1]"},
+		{CommentsReactions, 0, "[4 2]"},
+		{CommentsReactions, 2, "[1 5]"},
+	} {
+		comments, total, err := c.Page(1, tc.order, tc.after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []int
+		for _, comment := range comments {
+			ids = append(ids, comment.Id)
+		}
+
+		if fmt.Sprint(ids) != tc.want || total != 4 {
+			t.Errorf("%s after %d: got %v of %d, want %s of 4", tc.order, tc.after, ids, total, tc.want)
+		}
+	}
+
+	comments, total, err := c.Page(2, CommentsOldest, 0, 2)
+	if err != nil || len(comments) != 0 || total != 0 {
+		t.Errorf("post without comments: %v %d %v", comments, total, err)
+	}
+}
+
+func TestPurgePostComments(t *testing.T) {
+	db := storage.NewMemory()
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, postId := range []int{1, 1, 2} {
+		id, err := c.NewId(postId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Consume(postId, types.Comment{Id: id, UserName: "user@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stored, the last one of post 1 is still in the buffer
+	err = c.React(1, "a@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.React(3, "a@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.PurgePost(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, total, err := c.Page(1, CommentsOldest, 0, 10)
+	if err != nil || len(comments) != 0 || total != 0 {
+		t.Fatalf("%d comments left: %v", total, err)
+	}
+
+	for _, bucket := range []string{storage.CommentRecords, storage.CommentIndex, storage.CommentReactions} {
+		keys, _ := db.Keys(bucket)
+		if len(keys) != 1 || keys[0][0] != '3' {
+			t.Errorf("%s keys %v", bucket, keys)
+		}
+	}
+
+	_, total, _ = c.Page(2, CommentsOldest, 0, 10)
+	if total != 1 {
+		t.Error("comments of another post are purged")
+	}
+}
+
+func TestCommentRevisions(t *testing.T) {
+	db := storage.NewMemory()
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, err := c.NewId(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Consume(1, types.Comment{Id: id, UserName: "user@example.com", Content: "secret", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Edit(id, "user@example.com", "fixed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, _, err := c.Page(1, CommentsOldest, 0, 10)
+	if err != nil || len(page) != 1 || page[0].Content != "fixed" || page[0].Revisions != nil {
+		t.Fatalf("page shows earlier contents: %+v %v", page, err)
+	}
+	tree, err := c.GetTree(1, 0, 5, 0, 10)
+	if err != nil || len(tree) != 1 || tree[0].Revisions != nil {
+		t.Fatalf("tree shows earlier contents: %+v %v", tree, err)
+	}
+
+	revisions, err := c.Revisions(id, "user@example.com", false)
+	if err != nil || len(revisions) != 1 || revisions[0].Content != "secret" {
+		t.Errorf("author revisions: %+v %v", revisions, err)
+	}
+	revisions, err = c.Revisions(id, "mod@example.com", true)
+	if err != nil || len(revisions) != 1 {
+		t.Errorf("moderator revisions: %+v %v", revisions, err)
+	}
+	_, err = c.Revisions(id, "other@example.com", false)
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("revisions shown to another user: %v", err)
+	}
+}
+
+func TestEditComment(t *testing.T) {
+	db := storage.NewMemory()
+
+	w, err := NewCommentsWal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var ids []int
+	for _, created := range []time.Time{time.Now(), time.Now().Add(-2 * time.Minute)} {
+		id, err := c.NewId(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Consume(1, types.Comment{Id: id, UserName: "user@example.com", Content: "first", Created: created})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	fresh, old := ids[0], ids[1]
+
+	before := time.Now()
+
+	err = c.Edit(fresh, "user@example.com", "second", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comment, err := readComment(db, fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.Content != "second" || comment.Edited == nil || comment.Edited.Before(before) {
+		t.Errorf("not valid edited comment %+v", comment)
+	}
+	if len(comment.Revisions) != 1 || comment.Revisions[0].Content != "first" || !comment.Revisions[0].Replaced.Equal(*comment.Edited) {
+		t.Errorf("not valid revisions %+v", comment.Revisions)
+	}
+
+	err = c.Edit(fresh, "other@example.com", "spam", false)
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("another user edited the comment: %v", err)
+	}
+
+	err = c.Edit(old, "user@example.com", "late", false)
+	if !errors.Is(err, ErrEditWindowClosed) {
+		t.Errorf("edited after the window: %v", err)
+	}
+
+	// moderators are not bound by the window
+	err = c.Edit(old, "mod@example.com", "moderated", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment, _ = readComment(db, old)
+	if comment.Content != "moderated" || len(comment.Revisions) != 1 {
+		t.Errorf("not valid moderated comment %+v", comment)
+	}
+
+	err = c.Delete(fresh, "user@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Edit(fresh, "user@example.com", "third", false)
+	if !errors.Is(err, ErrCommentNotFound) {
+		t.Errorf("deleted comment is edited: %v", err)
+	}
+	err = c.Edit(100, "user@example.com", "third", false)
+	if !errors.Is(err, ErrCommentNotFound) {
+		t.Errorf("missing comment is edited: %v", err)
+	}
+
+	comment, _ = readComment(db, fresh)
+	if comment.Content != "second" || len(comment.Revisions) != 1 {
+		t.Errorf("failed edits changed the comment %+v", comment)
+	}
+}
+
+func TestPurgedCommentsAfterRestart(t *testing.T) {
+	db := storage.NewMemory()
+	dir := t.TempDir()
+
+	err := db.Write(storage.Posts, "1", []byte(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewCommentsWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		id, err := c.NewId(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Consume(1, types.Comment{Id: id, UserName: "user@example.com", Content: "comment"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stores the buffer of the post, the records stay in the wal
+	err = c.React(1, "a@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.PurgePost(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := w.segments()
+	if len(segments) != 1 || w.Size() != 0 {
+		t.Errorf("wal keeps records of the purged post: %v %d", segments, w.Size())
+	}
+
+	err = db.Delete(storage.Posts, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewCommentsWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCommentsService(db, w, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// replayed comments are stored by the flush
+	err = c.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, total, err := c.Page(1, CommentsOldest, 0, 10)
+	if err != nil || len(comments) != 0 || total != 0 {
+		t.Errorf("purged comments are back: %v %d %v", comments, total, err)
+	}
+}
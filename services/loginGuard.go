@@ -0,0 +1,266 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/config"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"time"
+)
+
+// LoginGuard slows down and locks accounts and ips with failed logins.
+// Failures are kept in storage, a restart does not reset them.
+type LoginGuard struct {
+	db        storage.Storage
+	account   loginPolicy
+	ip        loginPolicy
+	window    time.Duration
+	closeChan chan chan struct{}
+}
+
+// loginPolicy after max/2 failures every next login waits backoff,
+// doubled on each failure, after max failures it waits lockout
+type loginPolicy struct {
+	max     int
+	backoff time.Duration
+	lockout time.Duration
+}
+
+type loginFailures struct {
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+func NewLoginGuard(db storage.Storage, cfg *config.Config) *LoginGuard {
+	g := LoginGuard{
+		db:        db,
+		account:   loginPolicy{max: cfg.LoginMaxFailures, backoff: cfg.LoginBackoff, lockout: cfg.LoginLockout},
+		ip:        loginPolicy{max: cfg.LoginIPMaxFailures, backoff: cfg.LoginBackoff, lockout: cfg.LoginLockout},
+		window:    cfg.LoginFailureWindow,
+		closeChan: make(chan chan struct{}),
+	}
+	go g.janitor(cfg.TokenSweepInterval)
+
+	return &g
+}
+
+// Check how long the login has to wait, 0 when it can try now
+func (g *LoginGuard) Check(email, ip string) (retry time.Duration, err error) {
+	now := time.Now()
+
+	for _, c := range []struct {
+		key    string
+		policy loginPolicy
+	}{
+		{accountKey(email), g.account},
+		{ipKey(ip), g.ip},
+	} {
+		f, err := g.read(g.db, c.key, now)
+		if err != nil {
+			return 0, err
+		}
+
+		if wait := c.policy.wait(f, now); wait > retry {
+			retry = wait
+		}
+	}
+
+	return retry, nil
+}
+
+// Fail counts a failed login of the account from the ip
+func (g *LoginGuard) Fail(email, ip string) error {
+	now := time.Now()
+
+	var count int
+
+	err := g.db.Update(func(tx storage.Tx) error {
+		for i, key := range []string{accountKey(email), ipKey(ip)} {
+			f, err := g.read(tx, key, now)
+			if err != nil {
+				return err
+			}
+
+			f.Count++
+			f.Last = now
+
+			if i == 0 {
+				count = f.Count
+			}
+
+			b, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Write(storage.LoginFailures, key, b)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if count == g.account.max {
+		log.Warn().Str("email", email).Str("ip", ip).Msg("account locked after failed logins")
+	}
+
+	return nil
+}
+
+// Succeed forgets the failures of the account. Failures of the ip stay,
+// or one valid account would let an ip guess the others.
+func (g *LoginGuard) Succeed(email string) error {
+	return g.Unlock(email)
+}
+
+// Unlock forgets the failures of the account
+func (g *LoginGuard) Unlock(email string) error {
+	return g.delete(accountKey(email))
+}
+
+// UnlockIP forgets the failures of the ip
+func (g *LoginGuard) UnlockIP(ip string) error {
+	return g.delete(ipKey(ip))
+}
+
+// Sweep deletes failures older than the window
+func (g *LoginGuard) Sweep() (deleted int, err error) {
+	keys, err := g.db.Keys(storage.LoginFailures)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	for _, key := range keys {
+		err = g.db.Update(func(tx storage.Tx) error {
+			f, err := g.read(tx, key, now)
+			if err != nil || f.Count != 0 {
+				return err
+			}
+
+			err = tx.Delete(storage.LoginFailures, key)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+
+			deleted++
+
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// Close stops the janitor
+func (g *LoginGuard) Close() {
+	done := make(chan struct{})
+	g.closeChan <- done
+	<-done
+}
+
+func (g *LoginGuard) janitor(interval time.Duration) {
+	tic := time.NewTicker(interval)
+	defer tic.Stop()
+
+	for {
+		select {
+		case <-tic.C:
+			_, err := g.Sweep()
+			if err != nil {
+				log.Error().Err(err).Msg("sweep login failures")
+			}
+		case done := <-g.closeChan:
+			close(done)
+			return
+		}
+	}
+}
+
+// read failures within the window, older ones count as none
+func (g *LoginGuard) read(tx storage.Tx, key string, now time.Time) (f loginFailures, err error) {
+	b, err := tx.Read(storage.LoginFailures, key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return f, nil
+		}
+		return f, err
+	}
+
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return f, err
+	}
+
+	if now.Sub(f.Last) > g.window {
+		return loginFailures{}, nil
+	}
+
+	return f, nil
+}
+
+func (g *LoginGuard) delete(key string) error {
+	err := g.db.Delete(storage.LoginFailures, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (p loginPolicy) wait(f loginFailures, now time.Time) time.Duration {
+	free := p.max / 2
+
+	var delay time.Duration
+
+	switch {
+	case f.Count >= p.max:
+		delay = p.lockout
+	case f.Count > free:
+		delay = p.backoff
+		for i := free + 1; i < f.Count && delay < p.lockout; i++ {
+			delay *= 2
+		}
+		if delay > p.lockout {
+			delay = p.lockout
+		}
+	default:
+		return 0
+	}
+
+	wait := f.Last.Add(delay).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// accountKey the email is hashed, any string can be sent to the login
+func accountKey(email string) string {
+	return "account-" + failuresHash(email)
+}
+
+func ipKey(ip string) string {
+	return "ip-" + failuresHash(ip)
+}
+
+func failuresHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"github.com/TokDenis/micro-blog/config"
+	"github.com/TokDenis/micro-blog/storage"
+	"testing"
+	"time"
+)
+
+func TestLoginGuard(t *testing.T) {
+	db := storage.NewMemory()
+
+	cfg := config.Default()
+	cfg.LoginMaxFailures = 4
+	cfg.LoginIPMaxFailures = 100
+
+	g := NewLoginGuard(db, cfg)
+
+	for i := 0; i < 2; i++ {
+		err := g.Fail("user@example.com", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retry, _ := g.Check("user@example.com", "10.0.0.1")
+	if retry != 0 {
+		t.Errorf("waits %s after free failures", retry)
+	}
+
+	_ = g.Fail("user@example.com", "10.0.0.1")
+
+	retry, _ = g.Check("user@example.com", "10.0.0.2")
+	if retry <= 0 || retry > cfg.LoginBackoff {
+		t.Errorf("waits %s after the first backoff failure", retry)
+	}
+
+	_ = g.Fail("user@example.com", "10.0.0.1")
+	g.Close()
+
+	// counters are in storage
+	g = NewLoginGuard(db, cfg)
+	defer g.Close()
+
+	retry, _ = g.Check("user@example.com", "10.0.0.2")
+	if retry <= cfg.LoginLockout-time.Minute {
+		t.Errorf("locked account waits %s", retry)
+	}
+
+	retry, _ = g.Check("other@example.com", "10.0.0.1")
+	if retry != 0 {
+		t.Errorf("other account from the ip waits %s", retry)
+	}
+
+	err := g.Unlock("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retry, _ = g.Check("user@example.com", "10.0.0.2")
+	if retry != 0 {
+		t.Errorf("unlocked account waits %s", retry)
+	}
+}
+
+func TestLoginPolicyWait(t *testing.T) {
+	p := loginPolicy{max: 10, backoff: time.Second, lockout: time.Minute}
+	now := time.Now()
+
+	want := map[int]time.Duration{
+		5:  0,
+		6:  time.Second,
+		7:  2 * time.Second,
+		9:  8 * time.Second,
+		10: time.Minute,
+		50: time.Minute,
+	}
+
+	for count, w := range want {
+		got := p.wait(loginFailures{Count: count, Last: now}, now)
+		if got != w {
+			t.Errorf("%d failures: wait %s, want %s", count, got, w)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"strings"
+	"time"
+)
+
+// purposes of mail tokens, a token of one purpose is not accepted for another
+const (
+	MailVerify = "verify"
+	MailReset  = "reset"
+)
+
+// MailTokens signed tokens sent in mails. They are not stored, a token
+// carries a stamp of the account state it was made for, and stops
+// working once that state changes.
+type MailTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+type mailToken struct {
+	Purpose string `json:"p"`
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+	Stamp   string `json:"s"`
+}
+
+func NewMailTokens(db storage.Storage, ttl time.Duration) (*MailTokens, error) {
+	secret, err := loadSecret(db, "mail-tokens")
+	if err != nil {
+		return nil, err
+	}
+
+	return &MailTokens{secret: secret, ttl: ttl}, nil
+}
+
+func (m *MailTokens) Make(purpose, email, stamp string) (string, error) {
+	b, err := json.Marshal(mailToken{
+		Purpose: purpose,
+		Email:   email,
+		Expires: time.Now().Add(m.ttl).Unix(),
+		Stamp:   stamp,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	return payload + "." + m.sign(payload), nil
+}
+
+// Parse checks the signature, purpose and expiry, the stamp is checked
+// by the caller
+func (m *MailTokens) Parse(purpose, token string) (email, stamp string, err error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return "", "", ErrMailTokenInvalid
+	}
+	payload, sig := token[:i], token[i+1:]
+
+	if !hmac.Equal([]byte(sig), []byte(m.sign(payload))) {
+		return "", "", ErrMailTokenInvalid
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", ErrMailTokenInvalid
+	}
+
+	var t mailToken
+
+	err = json.Unmarshal(b, &t)
+	if err != nil || t.Purpose != purpose {
+		return "", "", ErrMailTokenInvalid
+	}
+
+	if time.Now().Unix() > t.Expires {
+		return "", "", ErrMailTokenExpired
+	}
+
+	return t.Email, t.Stamp, nil
+}
+
+func (m *MailTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// passwordStamp changes with the password, so a reset token works once
+func passwordStamp(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+var ErrMailTokenInvalid = errors.New("invalid token")
+var ErrMailTokenExpired = errors.New("token expired")
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"fmt"
+	"github.com/TokDenis/micro-blog/config"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends plain text mails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+func newMailer(cfg *config.Config) (Mailer, error) {
+	switch cfg.Mailer {
+	case "smtp":
+		return NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPUser, cfg.SMTPPassword, cfg.MailFrom), nil
+	case "file":
+		// kept open while the server runs
+		f, err := os.OpenFile(cfg.MailFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileMailer(f), nil
+	default:
+		return NewFileMailer(os.Stdout), nil
+	}
+}
+
+// SMTPMailer sends mails through an smtp relay
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer no auth is used when username is empty
+func NewSMTPMailer(addr, username, password, from string) *SMTPMailer {
+	m := SMTPMailer{
+		addr: addr,
+		from: from,
+	}
+
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &m
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var msg strings.Builder
+
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg.String()))
+}
+
+// FileMailer writes mails to a file or stdout instead of sending them,
+// for development and tests
+type FileMailer struct {
+	w io.Writer
+	m sync.Mutex
+}
+
+func NewFileMailer(w io.Writer) *FileMailer {
+	return &FileMailer{w: w}
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+
+	return err
+}
@@ -0,0 +1,22 @@
+package services
+
+import (
+	"expvar"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+)
+
+// metrics counters of the blog, served by Api.Metrics
+var metrics = expvar.NewMap("micro_blog")
+
+const (
+	MetricCommentsWalErrors   = "comments_wal_errors"
+	MetricCommentsFlushErrors = "comments_flush_errors"
+	MetricCommentsReplayed    = "comments_replayed"
+)
+
+func (a *Api) Metrics(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write([]byte(metrics.String()))
+}
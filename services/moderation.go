@@ -0,0 +1,209 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation the queue of pending posts and the decisions on them, every
+// decision leaves an audit record
+type Moderation struct {
+	db   storage.Storage
+	post *Post
+}
+
+func NewModeration(db storage.Storage, post *Post) *Moderation {
+	return &Moderation{db: db, post: post}
+}
+
+const moderationSequence = "moderation"
+
+// Queue pending posts, oldest first. author matches the author name or
+// email, query a part of the name, both are skipped when empty. after is
+// the id of the last post of the previous page, total the count of all
+// matching posts.
+func (m *Moderation) Queue(author, query string, after, limit int) (posts []*types.Post, total int, err error) {
+	query = strings.ToLower(query)
+
+	for _, id := range m.post.hiddenIds(types.PostPending) {
+		post, err := m.post.readPost(m.db, id)
+		if err != nil {
+			// purged after the ids were taken
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, 0, err
+		}
+
+		if author != "" && post.PostedBy != author && post.AuthorEmail != author {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(post.Name), query) {
+			continue
+		}
+
+		total++
+
+		if id > after && len(posts) < limit {
+			posts = append(posts, post)
+		}
+	}
+
+	return posts, total, nil
+}
+
+// Moderate applies the action to every post, a failed post does not stop
+// the others
+func (m *Moderation) Moderate(ids []int, action, reason string, moderator *types.UserInfo) []types.ModerationResult {
+	results := make([]types.ModerationResult, 0, len(ids))
+
+	for _, id := range ids {
+		result := types.ModerationResult{Id: id}
+
+		post, err := m.moderate(id, action, reason, moderator)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			result.Error = "post not found"
+		case err != nil:
+			result.Error = err.Error()
+		default:
+			result.Status = post.Status
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func (m *Moderation) moderate(id int, action, reason string, moderator *types.UserInfo) (post *types.Post, err error) {
+	if action == types.ModerationReject && reason == "" {
+		return nil, ErrReasonRequired
+	}
+
+	err = m.db.Update(func(tx storage.Tx) error {
+		post, err = m.post.readPost(tx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		switch action {
+		case types.ModerationApprove, types.ModerationUnapprove:
+			err = m.post.setValidity(tx, post, action == types.ModerationApprove, now)
+		case types.ModerationReject:
+			if post.IsDeleted {
+				return fs.ErrNotExist
+			}
+			if post.Status == types.PostDraft {
+				return ErrPostDraft
+			}
+			post.Status = types.PostRejected
+			post.IsApproved = false
+		default:
+			return ErrUnknownAction
+		}
+		if err != nil {
+			return err
+		}
+
+		post.Moderation = &types.PostModeration{
+			Action: action,
+			Reason: reason,
+			By:     moderator.Name,
+			At:     now,
+		}
+
+		err = m.post.setPost(tx, id, post)
+		if err != nil {
+			return err
+		}
+
+		return writeModerationRecord(tx, &types.ModerationRecord{
+			PostId:    id,
+			Action:    action,
+			Reason:    reason,
+			Moderator: moderator.Email,
+			At:        now,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.post.track(id, post)
+
+	return post, nil
+}
+
+// Log audit records, newest first. postId -1 lists every post. before is
+// the id of the last record of the previous page, 0 for the first page.
+func (m *Moderation) Log(postId, before, limit int) (records []*types.ModerationRecord, err error) {
+	keys, err := m.db.Keys(storage.ModerationLog)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, key := range keys {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		if before == 0 || id < before {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids {
+		b, err := m.db.Read(storage.ModerationLog, strconv.Itoa(id))
+		if err != nil {
+			return nil, err
+		}
+
+		var record types.ModerationRecord
+
+		err = json.Unmarshal(b, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		if postId >= 0 && record.PostId != postId {
+			continue
+		}
+
+		records = append(records, &record)
+		if len(records) == limit {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func writeModerationRecord(tx storage.Tx, record *types.ModerationRecord) (err error) {
+	record.Id, err = nextSequence(tx, moderationSequence)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.ModerationLog, strconv.Itoa(record.Id), b)
+}
+
+var ErrReasonRequired = errors.New("reason is required")
+var ErrUnknownAction = errors.New("unknown action")
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"testing"
+	"time"
+)
+
+func TestModeration(t *testing.T) {
+	db := storage.NewMemory()
+
+	p, err := NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	m := NewModeration(db, p)
+
+	author := &types.UserInfo{Email: "author@example.com", Name: "author"}
+	other := &types.UserInfo{Email: "other@example.com", Name: "other"}
+	moderator := &types.UserInfo{Email: "mod@example.com", Name: "mod"}
+
+	for _, req := range []struct {
+		name string
+		user *types.UserInfo
+	}{{"Go news", author}, {"cats", author}, {"go tips", other}, {"draft", author}} {
+		_, err = p.CreatePost(types.NewPostReq{Name: req.name, Draft: req.name == "draft"}, req.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		author, query string
+		after         int
+		want          string
+		total         int
+	}{
+		{"", "", -1, "[0 1]", 3},
+		{"", "", 1, "[2]", 3},
+		{"author@example.com", "", -1, "[0 1]", 2},
+		{"other", "", -1, "[2]", 1},
+		{"", "GO", -1, "[0 2]", 2},
+	} {
+		posts, total, err := m.Queue(tc.author, tc.query, tc.after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []int
+		for _, post := range posts {
+			ids = append(ids, post.Id)
+		}
+
+		if fmt.Sprint(ids) != tc.want || total != tc.total {
+			t.Errorf("queue %q %q after %d: got %v of %d, want %s of %d", tc.author, tc.query, tc.after, ids, total, tc.want, tc.total)
+		}
+	}
+
+	results := m.Moderate([]int{0, 3, 9}, types.ModerationApprove, "", moderator)
+	if fmt.Sprint(results) != "[{0 published } {3  post is a draft} {9  post not found}]" {
+		t.Errorf("not valid results %v", results)
+	}
+
+	results = m.Moderate([]int{1}, types.ModerationReject, "", moderator)
+	if results[0].Error != ErrReasonRequired.Error() {
+		t.Errorf("rejected without a reason: %v", results)
+	}
+
+	results = m.Moderate([]int{1, 2}, types.ModerationReject, "spam", moderator)
+	if results[0].Status != types.PostRejected || results[1].Status != types.PostRejected {
+		t.Fatalf("not valid results %v", results)
+	}
+
+	rejected, err := p.Rejected("author@example.com")
+	if err != nil || len(rejected) != 1 || rejected[0].Moderation.Reason != "spam" || rejected[0].Moderation.By != "mod" {
+		t.Fatalf("not valid rejected posts %v %v", rejected, err)
+	}
+
+	_, total, _ := m.Queue("", "", -1, 10)
+	if total != 0 {
+		t.Errorf("%d posts left in the queue", total)
+	}
+
+	// an edit sends a rejected post back to the queue
+	_, err = p.Edit(1, types.NewPostReq{Name: "cats"}, author, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, total, _ = m.Queue("", "", -1, 10)
+	if total != 1 {
+		t.Errorf("edited rejected post is not in the queue")
+	}
+
+	post, err := p.ReadPost(0)
+	if err != nil || post.Moderation != nil {
+		t.Errorf("moderation is served: %v", err)
+	}
+
+	records, err := m.Log(-1, 0, 10)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("got %d records: %v", len(records), err)
+	}
+	if records[0].PostId != 2 || records[0].Moderator != "mod@example.com" || records[2].Action != types.ModerationApprove {
+		t.Errorf("not valid records %+v", records)
+	}
+
+	records, _ = m.Log(1, 0, 10)
+	if len(records) != 1 || records[0].Reason != "spam" {
+		t.Errorf("not valid records of a post %+v", records)
+	}
+
+	records, _ = m.Log(-1, 3, 1)
+	if len(records) != 1 || records[0].PostId != 1 {
+		t.Errorf("not valid second page %+v", records)
+	}
+}
@@ -0,0 +1,521 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC OpenID Connect client for the authorization code flow with PKCE.
+// ID tokens are accepted only when signed with RS256 by a key of the
+// provider JWKS.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	// discovery and keys are loaded on first use, the provider may be down
+	// when the blog starts
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+	m         sync.Mutex
+
+	logins  map[string]*oidcLogin // [state]
+	loginsM sync.Mutex
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin a login sent to the provider and not back yet
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// OIDCClaims claims of a verified ID token the blog uses
+type OIDCClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	Expires       int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified oidcBool     `json:"email_verified"`
+	Name          string       `json:"name"`
+}
+
+const (
+	oidcLoginTTL = time.Minute * 10
+	// oidcSkew clock difference allowed with the provider
+	oidcSkew = time.Minute
+	// oidcKeysMinAge keys are fetched again for an unknown kid, at most this often
+	oidcKeysMinAge = time.Minute
+)
+
+func NewOIDC(issuer, clientID, clientSecret, redirectURL string, scopes []string) *OIDC {
+	return &OIDC{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: time.Second * 10},
+		logins:       make(map[string]*oidcLogin),
+	}
+}
+
+// AuthURL address of the provider login page, state ties the callback to it
+func (o *OIDC) AuthURL() (authURL, state string, err error) {
+	d, err := o.getDiscovery()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err = randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	// 64 characters, RFC 7636 wants 43 to 128
+	verifier, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+
+	o.loginsM.Lock()
+	for s, login := range o.logins {
+		if now.After(login.expires) {
+			delete(o.logins, s)
+		}
+	}
+	o.logins[state] = &oidcLogin{verifier: verifier, nonce: nonce, expires: now.Add(oidcLoginTTL)}
+	o.loginsM.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", o.clientID)
+	v.Set("redirect_uri", o.redirectURL)
+	v.Set("scope", strings.Join(o.scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return d.AuthorizationEndpoint + sep + v.Encode(), state, nil
+}
+
+// Exchange trades the code of the callback for verified claims
+func (o *OIDC) Exchange(state, code string) (*OIDCClaims, error) {
+	o.loginsM.Lock()
+	login, ok := o.logins[state]
+	delete(o.logins, state)
+	o.loginsM.Unlock()
+
+	if !ok || time.Now().After(login.expires) {
+		return nil, ErrOIDCState
+	}
+
+	d, err := o.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL)
+	form.Set("client_id", o.clientID)
+	form.Set("code_verifier", login.verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	}
+
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+
+	err = o.do(req, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+
+	return o.verify(tokens.IdToken, login.nonce)
+}
+
+// verify checks the ID token as OpenID Connect Core 3.1.3.7 says
+func (o *OIDC) verify(idToken, nonce string) (*OIDCClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, ErrOIDCToken
+	}
+
+	// never "none" or an HMAC with a public key as the secret
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: alg %q", ErrOIDCToken, header.Alg)
+	}
+
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOIDCToken
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature", ErrOIDCToken)
+	}
+
+	var claims OIDCClaims
+
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, ErrOIDCToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != o.issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrOIDCToken, claims.Issuer)
+	case !claims.Audience.has(o.clientID):
+		return nil, fmt.Errorf("%w: audience", ErrOIDCToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != o.clientID:
+		return nil, fmt.Errorf("%w: azp", ErrOIDCToken)
+	case now.Add(-oidcSkew).Unix() > claims.Expires:
+		return nil, fmt.Errorf("%w: expired", ErrOIDCToken)
+	case now.Add(oidcSkew).Unix() < claims.IssuedAt:
+		return nil, fmt.Errorf("%w: issued in the future", ErrOIDCToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce", ErrOIDCToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrOIDCToken)
+	}
+
+	return &claims, nil
+}
+
+func (o *OIDC) getDiscovery() (*oidcDiscovery, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, o.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d oidcDiscovery
+
+	err = o.do(req, &d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if d.Issuer != o.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q is not %q", d.Issuer, o.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: missing endpoints")
+	}
+
+	o.discovery = &d
+
+	return o.discovery, nil
+}
+
+// key public key of the kid, keys are fetched again when the provider
+// rotates them
+func (o *OIDC) key(kid string) (*rsa.PublicKey, error) {
+	d, err := o.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(o.keysAt) < oidcKeysMinAge {
+		return nil, fmt.Errorf("%w: unknown kid %q", ErrOIDCToken, kid)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err = o.do(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	o.keys = keys
+	o.keysAt = time.Now()
+
+	key, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown kid %q", ErrOIDCToken, kid)
+	}
+
+	return key, nil
+}
+
+func (o *OIDC) do(req *http.Request, v interface{}) error {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", req.URL, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// decodeJWTPart json of a base64url part of a JWT
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// oidcAudience aud is a string or a list of strings
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*a = oidcAudience{one}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+
+	return err
+}
+
+func (a oidcAudience) has(s string) bool {
+	return hasString(a, s)
+}
+
+// oidcBool some providers send email_verified as a string
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// OIDCLogin sends the browser to the provider. A cookie with the hash of
+// the state ties the callback to this browser, a state alone would let a
+// link log the visitor in to another account.
+func (a *Api) OIDCLogin(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	u, state, err := a.oidc.AuthURL()
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	var c fasthttp.Cookie
+	c.SetKey(oidcStateCookie)
+	c.SetValue(oidcStateHash(state))
+	c.SetPath("/api/v1/auth/oidc/")
+	c.SetMaxAge(int(oidcLoginTTL.Seconds()))
+	c.SetHTTPOnly(true)
+	// Lax, the provider sends the browser back with a top level GET
+	c.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	c.SetSecure(strings.HasPrefix(a.cfg.PublicURL, "https://"))
+	ctx.Response.Header.SetCookie(&c)
+
+	ctx.Redirect(u, fasthttp.StatusFound)
+}
+
+// OIDCCallback the provider sends the browser back here with a code. The
+// session is started like a password login, a user with two factors gets
+// the pre-auth token in the link back to the site.
+func (a *Api) OIDCCallback(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	args := ctx.QueryArgs()
+
+	if errCode := string(args.Peek("error")); errCode != "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte("oidc: " + errCode))
+		return
+	}
+
+	state := string(args.Peek("state"))
+
+	cookie := ctx.Request.Header.Cookie(oidcStateCookie)
+	ctx.Response.Header.DelClientCookie(oidcStateCookie)
+	if len(cookie) == 0 || subtle.ConstantTimeCompare(cookie, []byte(oidcStateHash(state))) != 1 {
+		log.Warn().Msg("oidc callback without the state cookie of the login")
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		_, _ = ctx.Write([]byte(ErrOIDCState.Error()))
+		return
+	}
+
+	claims, err := a.oidc.Exchange(state, string(args.Peek("code")))
+	if err != nil {
+		if errors.Is(err, ErrOIDCState) || errors.Is(err, ErrOIDCToken) {
+			log.Warn().Err(err).Msg("oidc callback")
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			_, _ = ctx.Write([]byte(err.Error()))
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	user, err := a.auth.OIDCUser(claims)
+	if err != nil {
+		if errors.Is(err, ErrOIDCEmailNotVerified) || errors.Is(err, ErrOIDCSubjectMismatch) || errors.Is(err, ErrIncorrectEmail) {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			_, _ = ctx.Write([]byte(err.Error()))
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	site := strings.TrimSuffix(a.cfg.PublicURL, "/")
+
+	if user.TOTPEnabled {
+		pre, err := a.preAuth.Make(user.Email)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+
+		ctx.Redirect(site+"/2fa?pre_auth_token="+pre.PreAuthToken, fasthttp.StatusFound)
+		return
+	}
+
+	a.startSession(ctx, user.Email)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		return
+	}
+
+	ctx.Redirect(site+"/", fasthttp.StatusFound)
+}
+
+// oidcStateCookie the hash of the state of the login started in the browser
+const oidcStateCookie = "oidc_state"
+
+func oidcStateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+var ErrOIDCState = errors.New("unknown or expired oidc login")
+var ErrOIDCToken = errors.New("invalid id token")
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/config"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/valyala/fasthttp"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP OpenID Connect provider that signs whatever claims the test sets
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims of the next ID token, the nonce of the authorize step is used
+	// unless they have one
+	claims map[string]interface{}
+	alg    string
+	// codes [code] code_challenge and nonce
+	codes map[string][2]string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, alg: "RS256", codes: make(map[string][2]string)}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+
+		saved, ok := idp.codes[r.Form.Get("code")]
+		delete(idp.codes, r.Form.Get("code"))
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != saved[0] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{"nonce": saved[1]}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, claims)})
+	})
+
+	idp.server = httptest.NewServer(mux)
+
+	return idp
+}
+
+// authorize what the provider does after the user logs in, returns the code
+func (idp *mockIdP) authorize(t *testing.T, authURL string) (state, code string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+		t.Fatalf("auth url %s", authURL)
+	}
+
+	code = randomString(t)
+	idp.codes[code] = [2]string{q.Get("code_challenge"), q.Get("nonce")}
+
+	return q.Get("state"), code
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": idp.alg, "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func randomString(t *testing.T) string {
+	s, err := randomHex(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+
+	o := NewOIDC(idp.server.URL, "blog", "secret", "http://blog.example.com/callback", []string{"openid", "email"})
+
+	login := func(claims map[string]interface{}) (*OIDCClaims, error) {
+		idp.claims = claims
+
+		authURL, _, err := o.AuthURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state, code := idp.authorize(t, authURL)
+
+		return o.Exchange(state, code)
+	}
+
+	now := time.Now().Unix()
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            idp.server.URL,
+			"sub":            "u-1",
+			"aud":            "blog",
+			"exp":            now + 300,
+			"iat":            now,
+			"email":          "user@example.com",
+			"email_verified": true,
+			"name":           "User",
+		}
+	}
+
+	claims, err := login(valid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "user@example.com" || !claims.EmailVerified || claims.Subject != "u-1" {
+		t.Errorf("claims %+v", claims)
+	}
+
+	// a state works once
+	_, err = o.Exchange("unknown", "code")
+	if !errors.Is(err, ErrOIDCState) {
+		t.Errorf("unknown state: %v", err)
+	}
+
+	bad := map[string]func(c map[string]interface{}){
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"audience": func(c map[string]interface{}) { c["aud"] = []string{"other"} },
+		"azp":      func(c map[string]interface{}) { c["aud"] = []string{"blog", "other"} },
+		"expired":  func(c map[string]interface{}) { c["exp"] = now - 600 },
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+	}
+
+	for name, change := range bad {
+		c := valid()
+		change(c)
+
+		_, err = login(c)
+		if !errors.Is(err, ErrOIDCToken) {
+			t.Errorf("%s: token is accepted: %v", name, err)
+		}
+	}
+
+	idp.alg = "none"
+	_, err = login(valid())
+	if !errors.Is(err, ErrOIDCToken) {
+		t.Errorf("alg none: token is accepted: %v", err)
+	}
+	idp.alg = "RS256"
+
+	// users are found by the verified email and linked to the subject
+	auth := NewAuth(storage.NewMemory(), NewFileMailer(&strings.Builder{}), nil, "")
+
+	user, err := auth.OIDCUser(claims)
+	if err != nil || user.Password != "" || user.OIDCSubject != "u-1" {
+		t.Fatalf("created user %+v %v", user, err)
+	}
+
+	_, err = auth.Sigin("user@example.com", "")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("user of the provider logs in without a password: %v", err)
+	}
+
+	other := *claims
+	other.Subject = "u-2"
+	_, err = auth.OIDCUser(&other)
+	if !errors.Is(err, ErrOIDCSubjectMismatch) {
+		t.Errorf("another subject takes the user: %v", err)
+	}
+
+	unverified := *claims
+	unverified.Email = "new@example.com"
+	unverified.EmailVerified = false
+	_, err = auth.OIDCUser(&unverified)
+	if !errors.Is(err, ErrOIDCEmailNotVerified) {
+		t.Errorf("not verified email is accepted: %v", err)
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	idp := newMockIdP(t)
+	defer idp.server.Close()
+
+	cfg := config.Default()
+	cfg.OIDCIssuer = idp.server.URL
+	cfg.OIDCClientID = "blog"
+	api := newTestApi(t, cfg, storage.NewMemory())
+
+	now := time.Now().Unix()
+	idp.claims = map[string]interface{}{
+		"iss":            idp.server.URL,
+		"sub":            "u-1",
+		"aud":            "blog",
+		"exp":            now + 300,
+		"iat":            now,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+
+	c := &testClient{t: t, api: api}
+
+	resp := c.do("GET", "/api/v1/auth/oidc/login", "")
+	if resp.StatusCode() != fasthttp.StatusFound {
+		t.Fatalf("login: %d %s", resp.StatusCode(), resp.Body())
+	}
+
+	var cookie fasthttp.Cookie
+	cookie.SetKey(oidcStateCookie)
+	if !resp.Header.Cookie(&cookie) || !cookie.HTTPOnly() || cookie.SameSite() != fasthttp.CookieSameSiteLaxMode {
+		t.Fatalf("state cookie: %s", cookie.String())
+	}
+
+	state, code := idp.authorize(t, string(resp.Header.Peek("Location")))
+	callback := "/api/v1/auth/oidc/callback?state=" + state + "&code=" + code
+
+	callbackWith := func(value string) int {
+		var req fasthttp.Request
+		req.SetRequestURI(callback)
+		if value != "" {
+			req.Header.SetCookie(oidcStateCookie, value)
+		}
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		api.server.Handler(&ctx)
+
+		return ctx.Response.StatusCode()
+	}
+
+	// a link with a state started in another browser
+	if status := callbackWith(""); status != fasthttp.StatusBadRequest {
+		t.Errorf("callback without the cookie: %d", status)
+	}
+	if status := callbackWith(oidcStateHash("other")); status != fasthttp.StatusBadRequest {
+		t.Errorf("callback with the cookie of another login: %d", status)
+	}
+
+	if status := callbackWith(string(cookie.Value())); status != fasthttp.StatusFound {
+		t.Errorf("callback of the browser that started the login: %d", status)
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Params cost of argon2id, stored in every hash next to the salt
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// passwordParams parameters of new hashes, hashes made with other ones
+// are replaced on the next successful login
+var passwordParams = argon2Params{
+	Memory:  64 * 1024,
+	Time:    1,
+	Threads: 4,
+	KeyLen:  32,
+	SaltLen: 16,
+}
+
+// hashPassword returns the hash in PHC string format
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	p := passwordParams
+
+	salt := make([]byte, p.SaltLen)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// checkPassword compares password with the stored value in constant time.
+// Values stored before hashing on the server are compared as is.
+// rehash is true when the stored value should be replaced with a new hash.
+func checkPassword(stored, password string) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(stored, "$") {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok, nil
+	}
+
+	p, salt, key, err := parsePasswordHash(stored)
+	if err != nil {
+		return false, false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	ok = subtle.ConstantTimeCompare(key, other) == 1
+
+	return ok, ok && p != passwordParams, nil
+}
+
+func parsePasswordHash(stored string) (p argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash")
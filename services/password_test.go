@@ -0,0 +1,73 @@
+package services
+
+import (
+	"bytes"
+	"github.com/TokDenis/micro-blog/storage"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, rehash, err := checkPassword(hash, "secret")
+	if err != nil || !ok || rehash {
+		t.Errorf("current hash: ok %v rehash %v err %v", ok, rehash, err)
+	}
+
+	ok, _, err = checkPassword(hash, "other")
+	if err != nil || ok {
+		t.Errorf("wrong password accepted: %v", err)
+	}
+
+	// stored before the server hashed passwords
+	ok, rehash, err = checkPassword("secret", "secret")
+	if err != nil || !ok || !rehash {
+		t.Errorf("legacy value: ok %v rehash %v err %v", ok, rehash, err)
+	}
+
+	old := passwordParams
+	passwordParams.Time++
+	defer func() { passwordParams = old }()
+
+	ok, rehash, err = checkPassword(hash, "secret")
+	if err != nil || !ok || !rehash {
+		t.Errorf("outdated params: ok %v rehash %v err %v", ok, rehash, err)
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	db := storage.NewMemory()
+	a := NewAuth(db, NewFileMailer(&bytes.Buffer{}), nil, "")
+
+	err := db.Write(storage.Users, "user@example.com", []byte(`{"email":"user@example.com","password":"legacy","roles":["author","moderator"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.Sigin("user@example.com", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := a.readUser(db, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.Password, "$") || len(user.Roles) != 2 {
+		t.Fatalf("not valid rehashed user %+v", user)
+	}
+
+	// the password changed between the check and the rehash
+	err = a.rehashPassword("user@example.com", "legacy", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := a.readUser(db, "user@example.com")
+	if after.Password != user.Password {
+		t.Error("rehash overwrote a changed password")
+	}
+}
@@ -2,50 +2,35 @@ package services
 
 import (
 	"encoding/binary"
-	"io"
-	"os"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"io/fs"
 	"time"
 )
 
 type PostIndex struct {
+	db storage.Storage
 }
 
-func NewPostIndex() (*PostIndex, error) {
-	os.MkdirAll("db/posts-index/bytime/", os.ModePerm)
-	return &PostIndex{}, nil
+func NewPostIndex(db storage.Storage) (*PostIndex, error) {
+	return &PostIndex{db: db}, nil
 }
 
-func (pt *PostIndex) Append(id int, ts time.Time) error {
-	f, err := os.OpenFile("db/posts-index/bytime/"+ts.Format("2006-01-02"), os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	bId := Uint64ToByte(uint64(id))
-
-	info, err := f.Stat()
-	if err != nil {
-		return err
-	}
-
-	_, err = f.WriteAt(bId, info.Size())
-	if err != nil {
-		return err
-	}
+func (pt *PostIndex) Append(tx storage.Tx, id int, ts time.Time) error {
+	return tx.Append(storage.PostIndex, ts.Format("2006-01-02"), Uint64ToByte(uint64(id)))
+}
 
-	return err
+// Remove drops the post from the day it was created
+func (pt *PostIndex) Remove(tx storage.Tx, id int, ts time.Time) error {
+	return removeId(tx, storage.PostIndex, ts.Format("2006-01-02"), id)
 }
 
 func (pt *PostIndex) PostsByDay(ts time.Time) (ids []int64, err error) {
-	f, err := os.OpenFile("db/posts-index/bytime/"+ts.Format("2006-01-02"), os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	b, err := io.ReadAll(f)
+	b, err := pt.db.Read(storage.PostIndex, ts.Format("2006-01-02"))
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
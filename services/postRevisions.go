@@ -0,0 +1,305 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"io/fs"
+	"strings"
+)
+
+// CurrentRevision names the current version of a post whatever its number
+const CurrentRevision = -1
+
+// maxDiffLines lines of both versions of a field a diff takes, the search
+// grows with the product of the two
+const maxDiffLines = 10000
+
+// Revisions versions of a post replaced by edits, oldest first
+func (p *Post) Revisions(id int) (revisions []*types.PostRevision, err error) {
+	post, err := p.readPost(p.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < post.Revision; i++ {
+		revision, err := p.readRevision(p.db, id, i)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// Revision a version of a post, the number of the current version or
+// CurrentRevision gives the post itself
+func (p *Post) Revision(id, revision int) (*types.PostRevision, error) {
+	post, err := p.readPost(p.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if revision == CurrentRevision {
+		revision = post.Revision
+	}
+
+	if revision < 0 || revision > post.Revision {
+		return nil, ErrRevisionNotFound
+	}
+
+	if revision == post.Revision {
+		return revisionOf(post), nil
+	}
+
+	return p.readRevision(p.db, id, revision)
+}
+
+// Diff changes made from revision from to revision to
+func (p *Post) Diff(id, from, to int) (*types.PostDiff, error) {
+	a, err := p.Revision(id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := p.Revision(id, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if tooLargeToDiff(a.Name, b.Name) || tooLargeToDiff(a.ShortPost, b.ShortPost) ||
+		tooLargeToDiff(a.MainPost, b.MainPost) {
+		return nil, ErrDiffTooLarge
+	}
+
+	return &types.PostDiff{
+		PostId:    id,
+		From:      a.Revision,
+		To:        b.Revision,
+		Name:      diffLines(a.Name, b.Name),
+		ShortPost: diffLines(a.ShortPost, b.ShortPost),
+		MainPost:  diffLines(a.MainPost, b.MainPost),
+	}, nil
+}
+
+func (p *Post) readRevision(tx storage.Tx, id, revision int) (*types.PostRevision, error) {
+	b, err := tx.Read(storage.PostRevisions, revisionKey(id, revision))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrRevisionNotFound
+		}
+		return nil, err
+	}
+
+	var r types.PostRevision
+
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// writeRevision a revision is written once
+func (p *Post) writeRevision(tx storage.Tx, revision *types.PostRevision) error {
+	key := revisionKey(revision.PostId, revision.Revision)
+
+	_, err := tx.Read(storage.PostRevisions, key)
+	if err == nil {
+		return fmt.Errorf("revision %s exists", key)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	b, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.PostRevisions, key, b)
+}
+
+func revisionKey(id, revision int) string {
+	return fmt.Sprintf("%d-%d", id, revision)
+}
+
+// revisionOf the current version of a post
+func revisionOf(post *types.Post) *types.PostRevision {
+	r := types.PostRevision{
+		PostId:    post.Id,
+		Revision:  post.Revision,
+		Name:      post.Name,
+		ShortPost: post.ShortPost,
+		MainPost:  post.MainPost,
+		EditedBy:  post.PostedBy,
+		Created:   post.Created,
+	}
+
+	if post.Edited != nil {
+		r.EditedBy = post.EditedBy
+		r.Created = *post.Edited
+	}
+
+	return &r
+}
+
+// sameContent the revision has the text of the post
+func sameContent(r *types.PostRevision, post *types.Post) bool {
+	return r.Name == post.Name && r.ShortPost == post.ShortPost && r.MainPost == post.MainPost
+}
+
+// changedShare share of the lines of both versions removed or added. An
+// edit too large to diff counts as changed entirely.
+func changedShare(old *types.PostRevision, req types.NewPostReq) float64 {
+	if tooLargeToDiff(old.Name, req.Name) || tooLargeToDiff(old.ShortPost, req.ShortPost) ||
+		tooLargeToDiff(old.MainPost, req.MainPost) {
+		return 1
+	}
+
+	var lines []types.DiffLine
+	lines = append(lines, diffLines(old.Name, req.Name)...)
+	lines = append(lines, diffLines(old.ShortPost, req.ShortPost)...)
+	lines = append(lines, diffLines(old.MainPost, req.MainPost)...)
+
+	changed, total := 0, 0
+	for _, line := range lines {
+		if line.Op != "=" {
+			changed++
+			total++
+			continue
+		}
+		// a kept line is in both versions
+		total += 2
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	return float64(changed) / float64(total)
+}
+
+// diffLines line diff by the longest common subsequence. Hirschberg's
+// split keeps memory linear in the number of lines, a full table of two
+// long posts would not fit.
+func diffLines(a, b string) []types.DiffLine {
+	var diff []types.DiffLine
+	diffSplit(splitLines(a), splitLines(b), &diff)
+	return diff
+}
+
+func diffSplit(x, y []string, diff *[]types.DiffLine) {
+	// common head and tail need no search
+	for len(x) > 0 && len(y) > 0 && x[0] == y[0] {
+		*diff = append(*diff, types.DiffLine{Op: "=", Text: x[0]})
+		x, y = x[1:], y[1:]
+	}
+	tail := 0
+	for tail < len(x) && tail < len(y) && x[len(x)-1-tail] == y[len(y)-1-tail] {
+		tail++
+	}
+	common := x[len(x)-tail:]
+	x, y = x[:len(x)-tail], y[:len(y)-tail]
+
+	switch {
+	case len(x) == 0 || len(y) == 0:
+		appendLines(diff, "-", x)
+		appendLines(diff, "+", y)
+	case len(x) == 1:
+		// after the trim x[0] is neither first nor last in y
+		k := -1
+		for j := range y {
+			if y[j] == x[0] {
+				k = j
+				break
+			}
+		}
+		if k < 0 {
+			appendLines(diff, "-", x)
+			appendLines(diff, "+", y)
+		} else {
+			appendLines(diff, "+", y[:k])
+			appendLines(diff, "=", x)
+			appendLines(diff, "+", y[k+1:])
+		}
+	default:
+		mid := len(x) / 2
+		head := lcsHead(x[:mid], y)
+		rest := lcsTail(x[mid:], y)
+
+		k := 0
+		for j := range head {
+			if head[j]+rest[j] > head[k]+rest[k] {
+				k = j
+			}
+		}
+
+		diffSplit(x[:mid], y[:k], diff)
+		diffSplit(x[mid:], y[k:], diff)
+	}
+
+	appendLines(diff, "=", common)
+}
+
+// lcsHead lengths of the common subsequence of x and y[:j] for every j
+func lcsHead(x, y []string) []int {
+	prev, row := make([]int, len(y)+1), make([]int, len(y)+1)
+	for i := range x {
+		for j := range y {
+			if x[i] == y[j] {
+				row[j+1] = prev[j] + 1
+			} else if prev[j+1] >= row[j] {
+				row[j+1] = prev[j+1]
+			} else {
+				row[j+1] = row[j]
+			}
+		}
+		prev, row = row, prev
+	}
+	return prev
+}
+
+// lcsTail lengths of the common subsequence of x and y[j:] for every j
+func lcsTail(x, y []string) []int {
+	prev, row := make([]int, len(y)+1), make([]int, len(y)+1)
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				row[j] = prev[j+1] + 1
+			} else if prev[j] >= row[j+1] {
+				row[j] = prev[j]
+			} else {
+				row[j] = row[j+1]
+			}
+		}
+		prev, row = row, prev
+	}
+	return prev
+}
+
+func appendLines(diff *[]types.DiffLine, op string, lines []string) {
+	for _, line := range lines {
+		*diff = append(*diff, types.DiffLine{Op: op, Text: line})
+	}
+}
+
+func tooLargeToDiff(a, b string) bool {
+	return strings.Count(a, "\n")+strings.Count(b, "\n")+2 > maxDiffLines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrDiffTooLarge     = errors.New("too large to diff")
+)
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// PublishDue publishes scheduled posts whose time has come
+func (p *Post) PublishDue(now time.Time) (published int, err error) {
+	var due []int
+
+	p.m.RLock()
+	for id, at := range p.scheduled {
+		if !at.After(now) {
+			due = append(due, id)
+		}
+	}
+	p.m.RUnlock()
+
+	sort.Ints(due)
+
+	for _, id := range due {
+		var post *types.Post
+
+		err = p.db.Update(func(tx storage.Tx) (err error) {
+			post, err = p.readPost(tx, id)
+			if err != nil {
+				return err
+			}
+
+			// unapproved or deleted after it was listed
+			if post.Status != types.PostScheduled || post.IsDeleted {
+				return nil
+			}
+
+			at := now
+			if post.PublishAt != nil && post.PublishAt.Before(now) {
+				at = *post.PublishAt
+			}
+
+			err = p.publish(tx, post, at)
+			if err != nil {
+				return err
+			}
+
+			return p.setPost(tx, id, post)
+		})
+		if err != nil {
+			return published, err
+		}
+
+		p.track(id, post)
+
+		if post.Status == types.PostPublished {
+			published++
+		}
+	}
+
+	return published, nil
+}
+
+// Drafts drafts of the user, the last edited first
+func (p *Post) Drafts(email string) ([]*types.Post, error) {
+	return p.postsOf(p.hiddenIds(types.PostDraft), email)
+}
+
+// Scheduled approved posts of the user waiting for their time, the last
+// edited first
+func (p *Post) Scheduled(email string) ([]*types.Post, error) {
+	return p.postsOf(p.hiddenIds(types.PostScheduled), email)
+}
+
+func (p *Post) postsOf(ids []int, email string) (posts []*types.Post, err error) {
+	for _, id := range ids {
+		post, err := p.readPost(p.db, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if post.AuthorEmail == email {
+			posts = append(posts, post)
+		}
+	}
+
+	sort.Slice(posts, func(i, j int) bool { return lastEdit(posts[i]).After(lastEdit(posts[j])) })
+
+	return posts, nil
+}
+
+func lastEdit(post *types.Post) time.Time {
+	if post.Edited != nil {
+		return *post.Edited
+	}
+	return post.Created
+}
+
+// Close stops the scheduler
+func (p *Post) Close() {
+	done := make(chan struct{})
+	p.closeChan <- done
+	<-done
+}
+
+func (p *Post) scheduler(interval time.Duration) {
+	tic := time.NewTicker(interval)
+	defer tic.Stop()
+
+	for {
+		select {
+		case now := <-tic.C:
+			published, err := p.PublishDue(now)
+			if err != nil {
+				log.Error().Err(err).Msg("publish scheduled posts")
+			}
+			if published != 0 {
+				log.Info().Msgf("published %d scheduled posts", published)
+			}
+		case done := <-p.closeChan:
+			close(done)
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"sort"
+)
+
+// TagCounts tags of published posts with the number of posts, the most
+// used first
+func (p *Post) TagCounts() []types.TagCount {
+	return p.tagCounts(p.tags)
+}
+
+// CategoryCounts categories of published posts with the number of posts
+func (p *Post) CategoryCounts() []types.TagCount {
+	return p.tagCounts(p.categories)
+}
+
+// TagPosts published posts with the tag, newest first, 5 per page. total
+// counts every page
+func (p *Post) TagPosts(tag string, page int) (posts []*types.Post, total int, err error) {
+	return p.tagPosts(p.tags, tag, page)
+}
+
+// CategoryPosts published posts in the category, like TagPosts
+func (p *Post) CategoryPosts(category string, page int) (posts []*types.Post, total int, err error) {
+	return p.tagPosts(p.categories, category, page)
+}
+
+func (p *Post) tagCounts(ti *TagIndex) []types.TagCount {
+	counts := []types.TagCount{}
+
+	for tag, ids := range ti.Tags() {
+		count := 0
+		for _, id := range ids {
+			if p.isValidPost(id) {
+				count++
+			}
+		}
+		if count > 0 {
+			counts = append(counts, types.TagCount{Name: tag, Count: count})
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+
+	return counts
+}
+
+func (p *Post) tagPosts(ti *TagIndex, tag string, page int) (posts []*types.Post, total int, err error) {
+	tag, err = normalizeTag(tag)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ids []int
+	for _, id := range ti.Ids(tag) {
+		if p.isValidPost(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	fromPostId := len(ids) - 1 - page*5
+	if page < 0 || fromPostId < 0 {
+		return nil, len(ids), nil
+	}
+
+	for i := fromPostId; i >= 0; i-- {
+		post, err := p.ReadPost(ids[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		if post == nil {
+			continue
+		}
+
+		posts = append(posts, post)
+		if len(posts) == 5 {
+			break
+		}
+	}
+
+	return posts, len(ids), nil
+}
+
+// postTags normalized tags and category of the request
+func postTags(req types.NewPostReq) (tags []string, category string, err error) {
+	tags, err = normalizeTags(req.Tags)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if req.Category != "" {
+		category, err = normalizeTag(req.Category)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return tags, category, nil
+}
+
+// writeTags moves the post in the tag and category indexes from old to
+// post, nil stands for no post
+func (p *Post) writeTags(tx storage.Tx, id int, old, post *types.Post) error {
+	oldTags, newTags, oldCategory, newCategory := tagChange(old, post)
+
+	err := p.tags.Write(tx, id, oldTags, newTags)
+	if err != nil {
+		return err
+	}
+
+	return p.categories.Write(tx, id, oldCategory, newCategory)
+}
+
+// applyTags the change of writeTags, once its tx commits
+func (p *Post) applyTags(id int, old, post *types.Post) {
+	oldTags, newTags, oldCategory, newCategory := tagChange(old, post)
+
+	p.tags.Apply(id, oldTags, newTags)
+	p.categories.Apply(id, oldCategory, newCategory)
+}
+
+func tagChange(old, post *types.Post) (oldTags, newTags, oldCategory, newCategory []string) {
+	if old != nil {
+		oldTags, oldCategory = old.Tags, categoryTags(old.Category)
+	}
+	if post != nil {
+		newTags, newCategory = post.Tags, categoryTags(post.Category)
+	}
+	return
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"io/fs"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Delete moves a post to the trash, it is hidden until restored. The
+// author or a moderator can do it.
+func (p *Post) Delete(id int, email string, moderator bool) error {
+	var post *types.Post
+
+	err := p.db.Update(func(tx storage.Tx) (err error) {
+		post, err = p.readPost(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if post.IsDeleted {
+			return fs.ErrNotExist
+		}
+
+		if post.AuthorEmail != email && !moderator {
+			return ErrForbidden
+		}
+
+		now := time.Now()
+		post.IsDeleted = true
+		post.Deleted = &now
+
+		return p.setPost(tx, id, post)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.track(id, post)
+
+	return nil
+}
+
+// Restore takes a post out of the trash, an approved post is shown again
+func (p *Post) Restore(id int) error {
+	var post *types.Post
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		var err error
+		post, err = p.readPost(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !post.IsDeleted {
+			return ErrPostNotDeleted
+		}
+
+		post.IsDeleted = false
+		post.Deleted = nil
+
+		return p.setPost(tx, id, post)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.track(id, post)
+
+	return nil
+}
+
+// Trash deleted posts, the last deleted first
+func (p *Post) Trash() (posts []*types.Post, err error) {
+	p.m.RLock()
+	ids := append([]int(nil), p.deletedPostIds...)
+	p.m.RUnlock()
+
+	for _, id := range ids {
+		post, err := p.readPost(p.db, id)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Deleted.After(*posts[j].Deleted) })
+
+	return posts, nil
+}
+
+// Purge deletes a post in the trash with its revisions, stats, tags and
+// time index entry. Its comments are purged by Comments.PurgePost.
+func (p *Post) Purge(id int) error {
+	var purged *types.Post
+
+	err := p.db.Update(func(tx storage.Tx) error {
+		post, err := p.readPost(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if !post.IsDeleted {
+			return ErrPostNotDeleted
+		}
+
+		purged = post
+
+		for i := 0; i < post.Revision; i++ {
+			err = deleteRecord(tx, storage.PostRevisions, revisionKey(id, i))
+			if err != nil {
+				return err
+			}
+		}
+
+		if post.Published != nil {
+			err = p.timeIndex.Remove(tx, id, *post.Published)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = p.writeTags(tx, id, post, nil)
+		if err != nil {
+			return err
+		}
+
+		err = deleteRecord(tx, storage.Stats, strconv.Itoa(id))
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(storage.Posts, strconv.Itoa(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	p.applyTags(id, purged, nil)
+
+	p.m.Lock()
+	p.deletedPostIds = withoutId(p.deletedPostIds, id)
+	p.postIds = withoutId(p.postIds, id)
+	p.m.Unlock()
+
+	return nil
+}
+
+// isOpen the post exists and is not in the trash
+func (p *Post) isOpen(id int) bool {
+	p.m.RLock()
+	i := sort.SearchInts(p.postIds, id)
+	exists := i < len(p.postIds) && p.postIds[i] == id
+	p.m.RUnlock()
+
+	return exists && !p.isDeleted(id)
+}
+
+func (p *Post) isDeleted(id int) bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	for _, deleted := range p.deletedPostIds {
+		if deleted == id {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteRecord a missing record is already deleted
+func deleteRecord(tx storage.Tx, bucket, key string) error {
+	err := tx.Delete(bucket, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func withoutId(ids []int, id int) []int {
+	filter := ids[:0]
+	for _, v := range ids {
+		if v != id {
+			filter = append(filter, v)
+		}
+	}
+	return filter
+}
+
+var ErrPostNotDeleted = errors.New("post is not in the trash")
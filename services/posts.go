@@ -2,120 +2,345 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/TokDenis/micro-blog/types"
-	"github.com/karrick/godirwalk"
 	"github.com/rs/zerolog/log"
-	"os"
+	"io/fs"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Post struct {
-	postIds      []int
-	validPostIds []int
-	timeIndex    *PostIndex
-	stats        *Stats
+	db             storage.Storage
+	postIds        []int
+	validPostIds   []int
+	deletedPostIds []int
+	hidden         map[int]string    // [post id] status of not shown posts
+	scheduled      map[int]time.Time // [post id] publish at
+	// m guards the ids, the scheduler changes them too
+	m         sync.RWMutex
+	timeIndex *PostIndex
+	// tags and categories hold every post, listings skip the hidden ones
+	tags       *TagIndex
+	categories *TagIndex
+	stats      *Stats
+	// reapproveRatio share of changed lines that hides an edited post
+	// until it is approved again, 0 never does
+	reapproveRatio float64
+	closeChan      chan chan struct{}
 }
 
-func NewPost(stats *Stats) (*Post, error) {
-	dbPath := "db/posts/"
-	os.MkdirAll(dbPath, os.ModePerm)
-	var filesCounter int
+// NewPost publishInterval is how often scheduled posts are checked
+func NewPost(db storage.Storage, stats *Stats, reapproveRatio float64, publishInterval time.Duration) (*Post, error) {
+	keys, err := db.Keys(storage.Posts)
+	if err != nil {
+		return nil, err
+	}
 
-	err := godirwalk.Walk(dbPath, &godirwalk.Options{
-		Callback: func(osPathname string, de *godirwalk.Dirent) error {
-			if de.IsDir() {
-				return nil
-			}
-			filesCounter++
-			return nil
-		},
-		Unsorted: true,
-	})
+	// ids are taken from the records themselves, a quarantined post leaves a gap
+	var postIds []int
+	for _, key := range keys {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			log.Warn().Str("key", key).Msg("skip post with not numeric id")
+			continue
+		}
+		postIds = append(postIds, id)
+	}
+
+	sort.Ints(postIds)
+
+	ind, err := NewPostIndex(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := NewTagIndex(db, storage.PostTags)
 	if err != nil {
 		return nil, err
 	}
 
-	ind, err := NewPostIndex()
+	categories, err := NewTagIndex(db, storage.PostCategories)
 	if err != nil {
 		return nil, err
 	}
 
-	if filesCounter != 0 {
-		filesCounter -= 1
-	} else {
-		filesCounter = -1
+	lastPost := -1
+	if len(postIds) != 0 {
+		lastPost = postIds[len(postIds)-1]
 	}
 
-	log.Info().Msgf("last post %d", filesCounter)
+	log.Info().Msgf("last post %d", lastPost)
 
-	p := &Post{
-		stats:     stats,
-		timeIndex: ind,
+	err = migratePostsSequence(db, lastPost)
+	if err != nil {
+		return nil, err
 	}
 
-	var postIds []int
+	p := &Post{
+		db:             db,
+		stats:          stats,
+		timeIndex:      ind,
+		tags:           tags,
+		categories:     categories,
+		reapproveRatio: reapproveRatio,
+		hidden:         make(map[int]string),
+		scheduled:      make(map[int]time.Time),
+		closeChan:      make(chan chan struct{}),
+	}
 
-	for i := 0; i <= filesCounter; i++ {
-		postIds = append(postIds, i)
-		post, err := p.ReadPost(i)
+	for _, id := range postIds {
+		post, err := p.readPost(db, id)
 		if err != nil {
 			return nil, err
 		}
 
-		if post.IsValid() {
-			p.addValidPost(i)
-		}
+		p.track(id, post)
 	}
 
 	p.postIds = postIds
 
-	return p, err
+	// posts due while the server was down
+	_, err = p.PublishDue(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	go p.scheduler(publishInterval)
+
+	return p, nil
 }
 
-func (p *Post) CreatePost(req types.NewPostReq, user *types.UserInfo) (id int, err error) {
-	id = p.postIds[len(p.postIds)-1] + 1
+// postsSequence counts allocated post ids, posts are numbered from 0
+const postsSequence = "posts"
 
-	f, err := os.OpenFile("db/posts/"+strconv.Itoa(id), os.O_RDWR|os.O_CREATE, os.ModePerm)
+// migratePostsSequence starts the sequence after the last post made
+// before ids were allocated by it
+func migratePostsSequence(db storage.Storage, lastPost int) error {
+	return db.Update(func(tx storage.Tx) error {
+		last, err := lastSequence(tx, postsSequence)
+		if err != nil || last > lastPost {
+			return err
+		}
+
+		return setSequence(tx, postsSequence, lastPost+1)
+	})
+}
+
+// CreatePost a draft or a post waiting for a moderator, it goes to the
+// time index when published
+func (p *Post) CreatePost(req types.NewPostReq, user *types.UserInfo) (id int, err error) {
+	tags, category, err := postTags(req)
 	if err != nil {
 		return -1, err
 	}
 
-	defer f.Close()
-
 	post := types.Post{
-		Id:        id,
 		Name:      req.Name,
 		ShortPost: req.ShortPost,
 		MainPost:  req.MainPost,
 		PostedBy:  user.Name,
 		Created:   time.Now(),
+		Status:    types.PostPending,
+		PublishAt: req.PublishAt,
+		Tags:      tags,
+		Category:  category,
+
+		AuthorEmail: user.Email,
 	}
 
-	b, err := json.Marshal(&post)
-	if err != nil {
-		return -1, err
+	if req.Draft {
+		post.Status = types.PostDraft
 	}
 
-	_, err = f.Write(b)
+	// post, its tags and stats are written together or not at all
+	err = p.db.Update(func(tx storage.Tx) error {
+		next, err := nextSequence(tx, postsSequence)
+		if err != nil {
+			return err
+		}
+
+		id = next - 1
+		post.Id = id
+
+		b, err := json.Marshal(&post)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Write(storage.Posts, strconv.Itoa(id), b)
+		if err != nil {
+			return err
+		}
+
+		err = p.writeTags(tx, id, nil, &post)
+		if err != nil {
+			return err
+		}
+
+		return p.stats.CreateStats(tx, id)
+	})
 	if err != nil {
 		return -1, err
 	}
 
+	p.applyTags(id, nil, &post)
+
+	p.m.Lock()
 	p.postIds = append(p.postIds, id)
+	p.m.Unlock()
+
+	p.track(id, &post)
+
+	return id, nil
+}
 
-	err = p.timeIndex.Append(post.Id, post.Created)
+// Edit replaces the content of a post of the editor, moderators edit any.
+// The replaced version is kept as a revision, a draft keeps none. A
+// substantial edit of an approved post hides it until approved again,
+// reapprove tells so.
+//
+// req.Draft moves a post between draft and pending, an edit of a rejected
+// post sends it to moderators again unless it is made a draft. req.PublishAt
+// reschedules a post not yet published.
+func (p *Post) Edit(id int, req types.NewPostReq, editor *types.UserInfo, moderator bool) (reapprove bool, err error) {
+	tags, category, err := postTags(req)
 	if err != nil {
-		return -1, err
+		return false, err
+	}
+
+	// diffed before the write lock, a long post takes a while
+	var diffed *types.PostRevision
+	var share float64
+	if p.reapproveRatio > 0 {
+		current, err := p.readPost(p.db, id)
+		if err != nil {
+			return false, err
+		}
+		diffed = revisionOf(current)
+		share = changedShare(diffed, req)
+	}
+
+	var old, post *types.Post
+
+	err = p.db.Update(func(tx storage.Tx) error {
+		post, err = p.readPost(tx, id)
+		if err != nil {
+			return err
+		}
+
+		copied := *post
+		old = &copied
+
+		if post.IsDeleted {
+			return fs.ErrNotExist
+		}
+
+		if post.AuthorEmail != editor.Email && !moderator {
+			return ErrForbidden
+		}
+
+		if post.Status != types.PostDraft {
+			err = p.writeRevision(tx, revisionOf(post))
+			if err != nil {
+				return err
+			}
+			post.Revision++
+		}
+
+		if post.IsApproved && p.reapproveRatio > 0 {
+			// edited meanwhile, rare enough to diff again
+			if !sameContent(diffed, post) {
+				share = changedShare(revisionOf(post), req)
+			}
+			reapprove = share >= p.reapproveRatio
+		}
+
+		now := time.Now()
+
+		post.Name = req.Name
+		post.ShortPost = req.ShortPost
+		post.MainPost = req.MainPost
+		post.Tags = tags
+		post.Category = category
+		post.Edited = &now
+		post.EditedBy = editor.Name
+
+		switch {
+		case reapprove:
+			post.Status = types.PostPending
+			post.IsApproved = false
+		case post.Status == types.PostDraft && !req.Draft:
+			post.Status = types.PostPending
+		case post.Status == types.PostPending && req.Draft:
+			post.Status = types.PostDraft
+		case post.Status == types.PostRejected:
+			post.Status = types.PostPending
+			if req.Draft {
+				post.Status = types.PostDraft
+			}
+		}
+
+		// a scheduled post keeps its time unless the edit gives another,
+		// fixing a typo must not publish it now
+		keepTime := old.Status == types.PostScheduled && req.PublishAt == nil
+		if post.Status != types.PostPublished && !keepTime {
+			post.PublishAt = req.PublishAt
+		}
+
+		err = p.writeTags(tx, id, old, post)
+		if err != nil {
+			return err
+		}
+
+		return p.setPost(tx, id, post)
+	})
+	if err != nil {
+		return false, err
 	}
 
-	err = p.stats.CreateStats(id)
+	p.applyTags(id, old, post)
+	p.track(id, post)
+
+	return reapprove, nil
+}
+
+// Rejected rejected posts of the user with the reasons, the last edited
+// first
+func (p *Post) Rejected(email string) ([]*types.Post, error) {
+	return p.postsOf(p.hiddenIds(types.PostRejected), email)
+}
+
+// Pending posts of the user waiting for a moderator, with the reason when
+// one sent the post back. The last edited first.
+func (p *Post) Pending(email string) ([]*types.Post, error) {
+	return p.postsOf(p.hiddenIds(types.PostPending), email)
+}
+
+// OwnPost a not deleted post of the user in any status. A draft, pending
+// or rejected post keeps its last moderation so the author sees why.
+func (p *Post) OwnPost(id int, email string) (*types.Post, error) {
+	post, err := p.readPost(p.db, id)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	return id, nil
+	if post.AuthorEmail != email || post.IsDeleted {
+		return nil, fs.ErrNotExist
+	}
+
+	post.AuthorEmail = ""
+
+	switch post.Status {
+	case types.PostDraft, types.PostPending, types.PostRejected:
+	default:
+		post.Moderation = nil
+	}
+
+	return post, nil
 }
 
 func (p *Post) DayTop(ts time.Time) (posts []*types.Post, err error) {
@@ -156,13 +381,17 @@ func (p *Post) GetPosts(from, count int) (posts []*types.Post, err error) {
 
 // LastPosts last 5 posts
 func (p *Post) LastPosts(page int) (posts []*types.Post, err error) {
-	fromPostId := len(p.validPostIds) - 1 - page*5
+	p.m.RLock()
+	validPostIds := append([]int(nil), p.validPostIds...)
+	p.m.RUnlock()
+
+	fromPostId := len(validPostIds) - 1 - page*5
 	if fromPostId < 0 {
 		return nil, nil
 	}
 
 	for i := fromPostId; i >= 0; i-- {
-		post, err := p.ReadPost(p.validPostIds[i])
+		post, err := p.ReadPost(validPostIds[i])
 		if err != nil {
 			return nil, err
 		}
@@ -186,6 +415,9 @@ func (p *Post) PostsByDay(ts time.Time) (posts []*types.Post, err error) {
 	for i := 0; i < len(postsIds); i++ {
 		post, err := p.ReadPost(int(postsIds[i]))
 		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
 			return nil, err
 		}
 
@@ -202,7 +434,32 @@ func (p *Post) ReadPost(id int) (*types.Post, error) {
 	if id < 0 {
 		return nil, nil
 	}
-	b, err := os.ReadFile("db/posts/" + strconv.Itoa(id))
+
+	post, err := p.readPost(p.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.stats.CountView(post.Id)
+
+	post.AuthorEmail = ""
+	post.Moderation = nil
+
+	return post, err
+}
+
+// isAuthor the post was written by the user
+func (p *Post) isAuthor(id int, email string) (bool, error) {
+	post, err := p.readPost(p.db, id)
+	if err != nil {
+		return false, err
+	}
+
+	return post.AuthorEmail == email, nil
+}
+
+func (p *Post) readPost(tx storage.Tx, id int) (*types.Post, error) {
+	b, err := tx.Read(storage.Posts, strconv.Itoa(id))
 	if err != nil {
 		return nil, err
 	}
@@ -214,15 +471,77 @@ func (p *Post) ReadPost(id int) (*types.Post, error) {
 		return nil, err
 	}
 
-	p.stats.CountView(post.Id)
+	// made before statuses, when every post went to the time index at once
+	if post.Status == "" {
+		post.Status = types.PostPending
+		if post.IsApproved {
+			post.Status = types.PostPublished
+		}
+		created := post.Created
+		post.Published = &created
+	}
 
 	return &post, err
 }
 
 func (p *Post) PostsPages() int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
 	return len(p.validPostIds)/5 + 1
 }
 
+func (p *Post) isValidPost(id int) bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	i := sort.SearchInts(p.validPostIds, id)
+	return i < len(p.validPostIds) && p.validPostIds[i] == id
+}
+
+// track files the post under the ids of its status
+func (p *Post) track(id int, post *types.Post) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.unValidPost(id)
+	p.deletedPostIds = withoutId(p.deletedPostIds, id)
+	delete(p.hidden, id)
+	delete(p.scheduled, id)
+
+	switch {
+	case post.IsDeleted:
+		p.deletedPostIds = append(p.deletedPostIds, id)
+	case post.IsValid():
+		p.addValidPost(id)
+	default:
+		p.hidden[id] = post.Status
+	}
+
+	if post.Status == types.PostScheduled && !post.IsDeleted {
+		var at time.Time
+		if post.PublishAt != nil {
+			at = *post.PublishAt
+		}
+		p.scheduled[id] = at
+	}
+}
+
+// hiddenIds not shown posts of the status, by id
+func (p *Post) hiddenIds(status string) (ids []int) {
+	p.m.RLock()
+	for id, s := range p.hidden {
+		if s == status {
+			ids = append(ids, id)
+		}
+	}
+	p.m.RUnlock()
+
+	sort.Ints(ids)
+
+	return ids
+}
+
 func (p *Post) addValidPost(id int) {
 	p.validPostIds = append(p.validPostIds, id)
 	sort.Slice(p.validPostIds, func(i, j int) bool { return p.validPostIds[i] < p.validPostIds[j] })
@@ -243,50 +562,80 @@ func (p *Post) unValidPost(id int) {
 	sort.Slice(p.validPostIds, func(i, j int) bool { return p.validPostIds[i] < p.validPostIds[j] })
 }
 
+// Validate approves a post, it is published at once or scheduled for its
+// PublishAt. validity false sends it back to moderation.
 func (p *Post) Validate(id int, validity bool) error {
-	post, err := p.ReadPost(id)
-	if err != nil {
-		return err
-	}
+	var post *types.Post
 
-	post.IsApproved = validity
+	err := p.db.Update(func(tx storage.Tx) (err error) {
+		post, err = p.readPost(tx, id)
+		if err != nil {
+			return err
+		}
 
-	err = p.setPost(id, post)
+		err = p.setValidity(tx, post, validity, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return p.setPost(tx, id, post)
+	})
 	if err != nil {
 		return err
 	}
 
-	if validity {
-		p.addValidPost(id)
-	} else {
-		p.unValidPost(id)
-	}
+	p.track(id, post)
 
-	return err
+	return nil
 }
 
-func (p *Post) setPost(id int, post *types.Post) error {
-	f, err := os.OpenFile("db/posts/"+strconv.Itoa(id), os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return err
+// setValidity changes the status, the caller writes the post
+func (p *Post) setValidity(tx storage.Tx, post *types.Post, validity bool, now time.Time) error {
+	// approving a post in the trash would show it
+	if post.IsDeleted {
+		return fs.ErrNotExist
 	}
 
-	defer f.Close()
+	if post.Status == types.PostDraft {
+		return ErrPostDraft
+	}
 
-	b, err := json.Marshal(post)
-	if err != nil {
-		return err
+	switch {
+	case !validity:
+		post.Status = types.PostPending
+		post.IsApproved = false
+	case post.PublishAt != nil && post.PublishAt.After(now):
+		post.Status = types.PostScheduled
+		post.IsApproved = true
+	default:
+		return p.publish(tx, post, now)
 	}
 
-	err = f.Truncate(int64(len(b)))
-	if err != nil {
-		return err
+	return nil
+}
+
+// publish shows an approved post, the first time it goes to the time
+// index under at
+func (p *Post) publish(tx storage.Tx, post *types.Post, at time.Time) error {
+	post.Status = types.PostPublished
+	post.IsApproved = true
+
+	if post.Published != nil {
+		return nil
 	}
 
-	_, err = f.WriteAt(b, 0)
+	post.Published = &at
+
+	return p.timeIndex.Append(tx, post.Id, at)
+}
+
+func (p *Post) setPost(tx storage.Tx, id int, post *types.Post) error {
+	b, err := json.Marshal(post)
 	if err != nil {
 		return err
 	}
 
-	return err
+	return tx.Write(storage.Posts, strconv.Itoa(id), b)
 }
+
+var ErrPostDraft = errors.New("post is a draft")
@@ -1,8 +1,16 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUnValidatePost(t *testing.T) {
@@ -40,3 +48,452 @@ func TestUnValidatePost(t *testing.T) {
 		t.Error("not valid validPostIds")
 	}
 }
+
+func TestCreatePost(t *testing.T) {
+	db := storage.NewMemory()
+
+	p, err := NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &types.UserInfo{Email: "user@example.com", Name: "user"}
+
+	for i := 0; i < 3; i++ {
+		id, err := p.CreatePost(types.NewPostReq{Name: "post"}, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != i {
+			t.Errorf("unexpected id %d, want %d", id, i)
+		}
+	}
+
+	err = p.Validate(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posts, err := p.LastPosts(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].Id != 1 {
+		t.Error("not valid last posts")
+	}
+
+	p, err = NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(p.postIds) != "[0 1 2]" || fmt.Sprint(p.validPostIds) != "[1]" {
+		t.Error("not valid posts after reload")
+	}
+}
+
+func TestEditPost(t *testing.T) {
+	db := storage.NewMemory()
+
+	p, err := NewPost(db, NewStats(db), 0.5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := &types.UserInfo{Email: "author@example.com", Name: "author"}
+	other := &types.UserInfo{Email: "other@example.com", Name: "other"}
+
+	id, err := p.CreatePost(types.NewPostReq{Name: "post", MainPost: "one\ntwo\nthree\nfour"}, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Validate(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Edit(id, types.NewPostReq{Name: "mine"}, other, false)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("edited a post of another user: %v", err)
+	}
+
+	// a typo fix keeps the approval
+	reapprove, err := p.Edit(id, types.NewPostReq{Name: "post", MainPost: "one\ntwo\nthree\nfive"}, author, false)
+	if err != nil || reapprove {
+		t.Fatalf("small edit: %v %v", reapprove, err)
+	}
+
+	reapprove, err = p.Edit(id, types.NewPostReq{Name: "new", MainPost: "all\nnew"}, other, true)
+	if err != nil || !reapprove {
+		t.Fatalf("rewrite: %v %v", reapprove, err)
+	}
+	if p.isValidPost(id) {
+		t.Error("rewritten post is still shown")
+	}
+
+	revisions, err := p.Revisions(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].EditedBy != "author" || revisions[1].MainPost != "one\ntwo\nthree\nfive" {
+		t.Fatalf("not valid revisions %+v", revisions)
+	}
+
+	diff, err := p.Diff(id, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(diff.MainPost) != "[{= one} {= two} {= three} {- four} {+ five}]" || len(diff.Name) != 1 {
+		t.Errorf("not valid diff %v %v", diff.Name, diff.MainPost)
+	}
+
+	diff, err = p.Diff(id, 1, CurrentRevision)
+	if err != nil || diff.To != 2 {
+		t.Fatalf("diff to the current version: %+v %v", diff, err)
+	}
+
+	_, err = p.Diff(id, 0, 3)
+	if !errors.Is(err, ErrRevisionNotFound) {
+		t.Errorf("diff to a missing revision: %v", err)
+	}
+
+	post, err := p.ReadPost(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.AuthorEmail != "" || post.Revision != 2 || post.EditedBy != "other" {
+		t.Errorf("not valid post %+v", post)
+	}
+
+	// too long to diff counts as a rewrite
+	err = p.Validate(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := "all\nnew" + strings.Repeat("\nline", maxDiffLines)
+	reapprove, err = p.Edit(id, types.NewPostReq{Name: "new", MainPost: long}, author, false)
+	if err != nil || !reapprove {
+		t.Fatalf("edit too long to diff: %v %v", reapprove, err)
+	}
+
+	_, err = p.Diff(id, 2, CurrentRevision)
+	if !errors.Is(err, ErrDiffTooLarge) {
+		t.Errorf("diff of a long post: %v", err)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := func(n int) string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = strconv.Itoa(rnd.Intn(4))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	for n := 0; n < 200; n++ {
+		a, b := text(rnd.Intn(12)), text(rnd.Intn(12))
+		diff := diffLines(a, b)
+
+		var old, new []string
+		kept := 0
+		for _, line := range diff {
+			if line.Op != "+" {
+				old = append(old, line.Text)
+			}
+			if line.Op != "-" {
+				new = append(new, line.Text)
+			}
+			if line.Op == "=" {
+				kept++
+			}
+		}
+		if strings.Join(old, "\n") != a || strings.Join(new, "\n") != b {
+			t.Fatalf("diff of %q and %q does not give them back: %v", a, b, diff)
+		}
+		if kept != lcsHead(splitLines(a), splitLines(b))[len(splitLines(b))] {
+			t.Fatalf("diff of %q and %q is not the shortest: %v", a, b, diff)
+		}
+	}
+
+	// a table of both line counts would take 200 MB
+	a, b := text(5000), text(5000)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	diff := diffLines(a, b)
+	runtime.ReadMemStats(&after)
+
+	if len(diff) < 5000 {
+		t.Fatalf("%d lines in the diff", len(diff))
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 32<<20 {
+		t.Errorf("diff of long texts allocated %d bytes", alloc)
+	}
+}
+
+func TestPostTrash(t *testing.T) {
+	db := storage.NewMemory()
+
+	p, err := NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &types.UserInfo{Email: "user@example.com", Name: "user"}
+
+	for i := 0; i < 3; i++ {
+		_, err = p.CreatePost(types.NewPostReq{Name: "post"}, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Validate(i, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = p.Edit(2, types.NewPostReq{Name: "edited"}, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Delete(1, "other@example.com", false)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("deleted a post of another user: %v", err)
+	}
+
+	for _, id := range []int{1, 2} {
+		err = p.Delete(id, "user@example.com", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	posts, _ := p.LastPosts(0)
+	if len(posts) != 1 || posts[0].Id != 0 {
+		t.Errorf("deleted posts are shown: %d posts", len(posts))
+	}
+	posts, _ = p.PostsByDay(time.Now())
+	if len(posts) != 1 {
+		t.Errorf("deleted posts are in the day top: %d posts", len(posts))
+	}
+
+	trash, err := p.Trash()
+	if err != nil || len(trash) != 2 || trash[0].Id != 2 {
+		t.Fatalf("not valid trash: %d posts %v", len(trash), err)
+	}
+
+	err = p.Restore(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts, _ = p.LastPosts(0)
+	if len(posts) != 2 {
+		t.Errorf("restored post is not shown: %d posts", len(posts))
+	}
+
+	err = p.Purge(1)
+	if !errors.Is(err, ErrPostNotDeleted) {
+		t.Errorf("purged a post not in the trash: %v", err)
+	}
+
+	err = p.Purge(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bucket := range []string{storage.Posts, storage.Stats, storage.PostRevisions} {
+		keys, _ := db.Keys(bucket)
+		for _, key := range keys {
+			if key == "2" || key == "2-0" {
+				t.Errorf("%s/%s is not purged", bucket, key)
+			}
+		}
+	}
+	ids, _ := p.timeIndex.PostsByDay(time.Now())
+	if fmt.Sprint(ids) != "[0 1]" {
+		t.Errorf("time index %v", ids)
+	}
+
+	// the id of the purged last post is not reused, after a restart too
+	p, err = NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.CreatePost(types.NewPostReq{Name: "post"}, user)
+	if err != nil || id != 3 {
+		t.Errorf("got id %d, want 3: %v", id, err)
+	}
+}
+
+func TestScheduledPost(t *testing.T) {
+	db := storage.NewMemory()
+
+	// made before statuses
+	err := db.Write(storage.Posts, "0", []byte(`{"id":0,"name":"old","is_approved":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if !p.isValidPost(0) {
+		t.Error("approved post made before statuses is not shown")
+	}
+
+	user := &types.UserInfo{Email: "user@example.com", Name: "user"}
+
+	id, err := p.CreatePost(types.NewPostReq{Name: "draft", Draft: true}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Validate(id, true)
+	if !errors.Is(err, ErrPostDraft) {
+		t.Fatalf("approved a draft: %v", err)
+	}
+
+	drafts, err := p.Drafts("user@example.com")
+	if err != nil || len(drafts) != 1 || drafts[0].Id != id {
+		t.Fatalf("not valid drafts %v %v", drafts, err)
+	}
+	drafts, _ = p.Drafts("other@example.com")
+	if len(drafts) != 0 {
+		t.Error("draft is listed to another user")
+	}
+
+	publishAt := time.Now().Add(48 * time.Hour)
+
+	_, err = p.Edit(id, types.NewPostReq{Name: "post", PublishAt: &publishAt}, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drafts, _ = p.Drafts("user@example.com")
+	if len(drafts) != 0 {
+		t.Error("submitted draft is still a draft")
+	}
+
+	err = p.Validate(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.isValidPost(id) {
+		t.Error("scheduled post is shown before its time")
+	}
+	scheduled, _ := p.Scheduled("user@example.com")
+	if len(scheduled) != 1 || scheduled[0].Status != types.PostScheduled {
+		t.Fatalf("not valid scheduled posts %v", scheduled)
+	}
+
+	// an edit without a time keeps the scheduled one
+	_, err = p.Edit(id, types.NewPostReq{Name: "post, fixed"}, user, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduled, _ = p.Scheduled("user@example.com")
+	if len(scheduled) != 1 || scheduled[0].PublishAt == nil || !scheduled[0].PublishAt.Equal(publishAt) {
+		t.Fatalf("edit changed the time of a scheduled post %v", scheduled)
+	}
+
+	published, err := p.PublishDue(time.Now())
+	if err != nil || published != 0 {
+		t.Fatalf("published %d posts before their time: %v", published, err)
+	}
+
+	published, err = p.PublishDue(publishAt.Add(time.Minute))
+	if err != nil || published != 1 {
+		t.Fatalf("published %d posts: %v", published, err)
+	}
+	if !p.isValidPost(id) {
+		t.Error("published post is not shown")
+	}
+
+	posts, err := p.PostsByDay(publishAt)
+	if err != nil || len(posts) != 1 || posts[0].Id != id {
+		t.Errorf("published post is not indexed under its day: %v", err)
+	}
+}
+
+func TestPostTags(t *testing.T) {
+	db := storage.NewMemory()
+
+	p, err := NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &types.UserInfo{Email: "user@example.com", Name: "user"}
+
+	_, err = p.CreatePost(types.NewPostReq{Name: "bad", Tags: []string{"a/b"}}, user)
+	if !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("tag with a slash is accepted: %v", err)
+	}
+
+	var ids []int
+	for i := 0; i < 7; i++ {
+		id, err := p.CreatePost(types.NewPostReq{Name: "post", Tags: []string{"Go News", "go-news"}, Category: "Tech"}, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if counts := p.TagCounts(); len(counts) != 0 {
+		t.Errorf("tags of pending posts are counted: %v", counts)
+	}
+
+	for _, id := range ids {
+		err = p.Validate(id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := p.TagCounts()
+	if len(counts) != 1 || counts[0] != (types.TagCount{Name: "go-news", Count: 7}) {
+		t.Fatalf("not valid tag counts %v", counts)
+	}
+
+	posts, total, err := p.TagPosts("Go News", 0)
+	if err != nil || total != 7 || len(posts) != 5 || posts[0].Id != ids[6] {
+		t.Fatalf("first page: %d posts of %d, %v", len(posts), total, err)
+	}
+	posts, _, _ = p.TagPosts("go-news", 1)
+	if len(posts) != 2 || posts[1].Id != ids[0] {
+		t.Fatalf("second page: %v", posts)
+	}
+
+	_, err = p.Edit(ids[0], types.NewPostReq{Name: "post", Tags: []string{"rust"}}, user, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Validate(ids[1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts = p.TagCounts()
+	if len(counts) != 2 || counts[0].Count != 5 || counts[1] != (types.TagCount{Name: "rust", Count: 1}) {
+		t.Errorf("not valid tag counts after edit %v", counts)
+	}
+	counts = p.CategoryCounts()
+	if len(counts) != 1 || counts[0] != (types.TagCount{Name: "tech", Count: 5}) {
+		t.Errorf("not valid category counts %v", counts)
+	}
+
+	// reloaded from storage
+	p.Close()
+	p, err = NewPost(db, NewStats(db), 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, total, _ = p.CategoryPosts("tech", 0)
+	if total != 5 {
+		t.Errorf("%d posts in the category after reload", total)
+	}
+}
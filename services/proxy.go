@@ -1,15 +1,17 @@
 package services
 
 import (
+	"github.com/TokDenis/micro-blog/config"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
 	"strings"
 	"time"
 )
 
-func StartProxy() {
+// StartProxy serves pages and proxies api requests in the background.
+func StartProxy(cfg *config.Config) *fasthttp.Server {
 	fs := &fasthttp.FS{
-		Root:       "/www/micro-blog",
+		Root:       cfg.StaticRoot,
 		IndexNames: []string{"index.html"},
 		Compress:   true,
 	}
@@ -24,7 +26,7 @@ func StartProxy() {
 
 		switch {
 		case strings.HasPrefix(string(ctx.Path()), "/api"):
-			err := proxy("localhost:8080", ctx)
+			err := proxy(cfg.ApiUpstream(), ctx)
 			if err != nil {
 				log.Error().Err(err).Send()
 				return
@@ -38,13 +40,19 @@ func StartProxy() {
 	s := &fasthttp.Server{
 		Handler: requestHandler,
 		Name:    "micro-blog-proxy",
+		// idle keep-alive connections would hold Shutdown forever
+		IdleTimeout: time.Second * 5,
 	}
 
 	log.Info().Msg("micro-blog-proxy ok")
 
-	if err := s.ListenAndServe(":80"); err != nil {
-		log.Fatal().Err(err).Send()
-	}
+	go func() {
+		if err := s.ListenAndServe(cfg.ProxyAddr); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}()
+
+	return s
 }
 
 var (
@@ -55,6 +63,8 @@ var (
 
 func proxy(server string, ctx *fasthttp.RequestCtx) error {
 	ctx.Request.SetHost(server)
+	// replaced, not appended, a client could send its own
+	ctx.Request.Header.Set(fasthttp.HeaderXForwardedFor, ctx.RemoteIP().String())
 
 	err := fasthttp.DoTimeout(&ctx.Request, &ctx.Response, time.Second*10)
 	if err != nil {
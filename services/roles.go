@@ -0,0 +1,125 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+	"io/fs"
+)
+
+// RequireRole lets through users with the role, goes inside AuthMiddleware
+func (a *Api) RequireRole(role string, next fasthttprouter.Handle) fasthttprouter.Handle {
+	return func(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+		email := ctx.UserValue("_email").(string)
+
+		user, err := a.auth.UserInfo(email)
+		if err != nil {
+			a.internalErr(ctx, err)
+			return
+		}
+
+		if !user.HasRole(role) {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			return
+		}
+
+		if !a.canUseRole(user, role) {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			_, _ = ctx.Write([]byte(ErrTwoFactorRequired.Error()))
+			return
+		}
+
+		next(ctx, p)
+	}
+}
+
+// SetRole grants or revokes a role of a user, admin only
+func (a *Api) SetRole(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	var roleReq types.RoleReq
+
+	err := json.Unmarshal(ctx.PostBody(), &roleReq)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	err = a.auth.SetRole(roleReq.Email, roleReq.Role, roleReq.Grant)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrUnknownRole) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	log.Info().Str("by", ctx.UserValue("_email").(string)).Str("email", roleReq.Email).
+		Str("role", roleReq.Role).Bool("grant", roleReq.Grant).Msg("role changed")
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// bootstrapAdmins grants admin to users listed in the config
+func (a *Api) bootstrapAdmins(emails []string) error {
+	for _, email := range emails {
+		user, err := a.auth.UserInfo(email)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Warn().Str("email", email).Msg("admin from config is not registered yet")
+				continue
+			}
+			return err
+		}
+
+		if user.HasRole(types.RoleAdmin) {
+			continue
+		}
+
+		err = a.auth.SetRole(email, types.RoleAdmin, true)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Str("email", email).Msg("admin role granted from config")
+	}
+
+	return nil
+}
+
+// isModerator moderators can edit and delete any post or comment
+func (a *Api) isModerator(email string) (bool, error) {
+	user, err := a.auth.UserInfo(email)
+	if err != nil {
+		return false, err
+	}
+
+	return a.canUseRole(user, types.RoleModerator), nil
+}
+
+// canUseRole the user has the role and, for a role in TwoFactorRoles, a
+// second factor turned on. Every check of a role goes through it.
+func (a *Api) canUseRole(user *types.UserInfo, role string) bool {
+	if !user.TOTPEnabled {
+		limited := *user
+		limited.Roles = withoutRoles(user.Roles, a.cfg.TwoFactorRoles)
+		user = &limited
+	}
+
+	return user.HasRole(role)
+}
+
+func withoutRoles(roles, drop []string) (left []string) {
+	for _, r := range roles {
+		keep := true
+		for _, d := range drop {
+			keep = keep && r != d
+		}
+		if keep {
+			left = append(left, r)
+		}
+	}
+	return left
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"io/fs"
+)
+
+// loadSecret a random key made on the first start and kept in storage,
+// so signatures stay valid across restarts
+func loadSecret(db storage.Storage, name string) (secret []byte, err error) {
+	err = db.Update(func(tx storage.Tx) error {
+		secret, err = tx.Read(storage.Secrets, name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		secret = make([]byte, 32)
+
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+
+		return tx.Write(storage.Secrets, name, secret)
+	})
+
+	return secret, err
+}
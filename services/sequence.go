@@ -0,0 +1,40 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"io/fs"
+	"strconv"
+)
+
+// nextSequence returns the next value of the named counter, starting from 1
+func nextSequence(tx storage.Tx, name string) (int, error) {
+	last, err := lastSequence(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	err = setSequence(tx, name, last+1)
+	if err != nil {
+		return 0, err
+	}
+
+	return last + 1, nil
+}
+
+// lastSequence returns 0 for a counter that was never used
+func lastSequence(tx storage.Tx, name string) (int, error) {
+	b, err := tx.Read(storage.Sequences, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(string(b))
+}
+
+func setSequence(tx storage.Tx, name string, v int) error {
+	return tx.Write(storage.Sequences, name, []byte(strconv.Itoa(v)))
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttprouter"
+	"strconv"
+
+	"github.com/kataras/go-sessions/v3"
+)
+
+// Sessions not expired logins of the user
+func (a *Api) Sessions(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	email := ctx.UserValue("_email").(string)
+	token := ctx.UserValue("_token").(string)
+
+	list, err := a.token.Sessions(email, token)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(b)
+}
+
+// DeleteSession logs out one session of the user, it may be the current one
+func (a *Api) DeleteSession(ctx *fasthttp.RequestCtx, p fasthttprouter.Params) {
+	email := ctx.UserValue("_email").(string)
+
+	err := a.token.DeleteSession(email, p.ByName("id"))
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		}
+		a.internalErr(ctx, err)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
+
+// DeleteSessions logs the user out everywhere, the current session too
+func (a *Api) DeleteSessions(ctx *fasthttp.RequestCtx, _ fasthttprouter.Params) {
+	email := ctx.UserValue("_email").(string)
+
+	deleted, err := a.token.DeleteSessions(email)
+	if err != nil {
+		a.internalErr(ctx, err)
+		return
+	}
+
+	sessions.StartFasthttp(ctx).Delete(TokenKey)
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write([]byte(strconv.Itoa(deleted)))
+}
+
+// clientIP the proxy passes the client address in X-Forwarded-For,
+// the header is trusted only from the local proxy
+func clientIP(ctx *fasthttp.RequestCtx) string {
+	ip := ctx.RemoteIP()
+
+	forwarded := string(ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor))
+	if forwarded != "" && ip.IsLoopback() {
+		return forwarded
+	}
+
+	return ip.String()
+}
@@ -2,114 +2,133 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
 	"github.com/TokDenis/micro-blog/types"
 	"github.com/rs/zerolog/log"
-	"io"
-	"os"
+	"io/fs"
 	"strconv"
 	"time"
 )
 
 type Stats struct {
+	db        storage.Storage
 	viewsChan chan int
+	closeChan chan chan error
+	closed    chan struct{}
 }
 
-func NewStats() *Stats {
-	os.MkdirAll("db/stats/", os.ModePerm)
+func NewStats(db storage.Storage) *Stats {
 	s := Stats{
+		db:        db,
 		viewsChan: make(chan int, 1000),
+		closeChan: make(chan chan error),
+		closed:    make(chan struct{}),
 	}
 	go s.viewsCollector()
 
 	return &s
 }
 
-func (s *Stats) CreateStats(postId int) error {
-	f, err := os.OpenFile("db/stats/"+strconv.Itoa(postId), os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
+func (s *Stats) CreateStats(tx storage.Tx, postId int) error {
 	b, err := json.Marshal(types.Stats{
 		Id:    postId,
 		Views: 0,
 	})
-
-	f.Write(b)
-	return err
-}
-
-func (s *Stats) addViews(postId, count int) error {
-	f, err := os.OpenFile("db/stats/"+strconv.Itoa(postId), os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	return tx.Write(storage.Stats, strconv.Itoa(postId), b)
+}
 
-	b, err := io.ReadAll(f)
-	if err != nil {
-		return err
-	}
+func (s *Stats) addViews(postId, count int) error {
+	return s.db.Update(func(tx storage.Tx) error {
+		b, err := tx.Read(storage.Stats, strconv.Itoa(postId))
+		if err != nil {
+			// viewed before it was purged
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
 
-	var stats types.Stats
+		var stats types.Stats
 
-	err = json.Unmarshal(b, &stats)
-	if err != nil {
-		return err
-	}
+		err = json.Unmarshal(b, &stats)
+		if err != nil {
+			return err
+		}
 
-	stats.Views += int64(count)
+		stats.Views += int64(count)
 
-	err = f.Truncate(int64(len(b)))
-	if err != nil {
-		return err
-	}
+		b, err = json.Marshal(&stats)
+		if err != nil {
+			return err
+		}
 
-	b, err = json.Marshal(&stats)
-	if err != nil {
-		return err
+		return tx.Write(storage.Stats, strconv.Itoa(postId), b)
+	})
+}
+
+// CountView counts the view on the next flush. After Close the view is
+// dropped, requests outliving a timed out shutdown must not block.
+func (s *Stats) CountView(postId int) {
+	select {
+	case <-s.closed:
+		return
+	default:
 	}
 
-	_, err = f.WriteAt(b, 0)
-	if err != nil {
-		return err
+	select {
+	case s.viewsChan <- postId:
+	case <-s.closed:
 	}
-	return err
 }
 
-func (s *Stats) CountView(postId int) {
-	s.viewsChan <- postId
+// Close stops the collector and writes the views counted so far
+func (s *Stats) Close() error {
+	done := make(chan error)
+	s.closeChan <- done
+	return <-done
 }
 
 func (s *Stats) viewsCollector() {
 	viewsMap := make(map[int]int)
 	tic := time.NewTicker(time.Second)
-
-	go func() {
-		for {
-			select {
-			case <-tic.C:
-				for postId, count := range viewsMap {
-					err := s.addViews(postId, count)
-					if err != nil {
-						log.Error().Err(err).Send()
-					}
-					delete(viewsMap, postId)
-				}
+	defer tic.Stop()
+
+	for {
+		select {
+		case postId := <-s.viewsChan:
+			viewsMap[postId]++
+		case <-tic.C:
+			s.flushViews(viewsMap)
+		case done := <-s.closeChan:
+			close(s.closed)
+			for len(s.viewsChan) != 0 {
+				viewsMap[<-s.viewsChan]++
 			}
+			done <- s.flushViews(viewsMap)
+			return
 		}
-	}()
+	}
+}
 
-	for postId := range s.viewsChan {
-		viewsMap[postId]++
+func (s *Stats) flushViews(viewsMap map[int]int) (err error) {
+	for postId, count := range viewsMap {
+		addErr := s.addViews(postId, count)
+		if addErr != nil {
+			log.Error().Err(addErr).Int("post", postId).Msg("add views")
+			err = addErr
+		}
+		delete(viewsMap, postId)
 	}
+	return err
 }
 
 func (s *Stats) ReadStats(postId int) (*types.Stats, error) {
-	b, err := os.ReadFile("db/stats/" + strconv.Itoa(postId))
+	b, err := s.db.Read(storage.Stats, strconv.Itoa(postId))
 	if err != nil {
 		return nil, err
 	}
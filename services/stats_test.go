@@ -0,0 +1,49 @@
+package services
+
+import (
+	"github.com/TokDenis/micro-blog/storage"
+	"testing"
+	"time"
+)
+
+func TestStatsClose(t *testing.T) {
+	db := storage.NewMemory()
+	s := NewStats(db)
+
+	err := db.Update(func(tx storage.Tx) error {
+		return s.CreateStats(tx, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.CountView(1)
+	}
+
+	// views still in the collector are written on close
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.ReadStats(1)
+	if err != nil || stats.Views != 3 {
+		t.Fatalf("not valid stats after close %+v %v", stats, err)
+	}
+
+	// requests outliving a timed out shutdown, more than the channel holds
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2000; i++ {
+			s.CountView(1)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CountView blocks after Close")
+	}
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTags      = 10
+	maxTagLength = 32
+)
+
+// TagIndex ids of posts by tag or by category. The bucket is written in
+// the transaction of the post, the copy in memory after it commits.
+type TagIndex struct {
+	bucket string
+	ids    map[string][]int // [tag] sorted post ids
+	m      sync.RWMutex
+}
+
+func NewTagIndex(db storage.Storage, bucket string) (*TagIndex, error) {
+	keys, err := db.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	ti := TagIndex{
+		bucket: bucket,
+		ids:    make(map[string][]int, len(keys)),
+	}
+
+	for _, key := range keys {
+		ids, err := readIds(db, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		sort.Ints(ids)
+		ti.ids[key] = ids
+	}
+
+	return &ti, nil
+}
+
+// Write moves the post from the old tags to the new ones, Apply must
+// follow once tx commits
+func (ti *TagIndex) Write(tx storage.Tx, id int, old, new []string) error {
+	for _, tag := range old {
+		if !hasString(new, tag) {
+			err := removeId(tx, ti.bucket, tag, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, tag := range new {
+		if !hasString(old, tag) {
+			err := tx.Append(ti.bucket, tag, Uint64ToByte(uint64(id)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply the change written by Write to the copy in memory
+func (ti *TagIndex) Apply(id int, old, new []string) {
+	ti.m.Lock()
+	defer ti.m.Unlock()
+
+	for _, tag := range old {
+		if hasString(new, tag) {
+			continue
+		}
+		ids := withoutId(ti.ids[tag], id)
+		if len(ids) == 0 {
+			delete(ti.ids, tag)
+			continue
+		}
+		ti.ids[tag] = ids
+	}
+
+	for _, tag := range new {
+		if hasString(old, tag) {
+			continue
+		}
+		ids := append(ti.ids[tag], id)
+		sort.Ints(ids)
+		ti.ids[tag] = ids
+	}
+}
+
+// Ids post ids with the tag, sorted
+func (ti *TagIndex) Ids(tag string) []int {
+	ti.m.RLock()
+	defer ti.m.RUnlock()
+
+	return append([]int(nil), ti.ids[tag]...)
+}
+
+// Tags every tag with its post ids
+func (ti *TagIndex) Tags() map[string][]int {
+	ti.m.RLock()
+	defer ti.m.RUnlock()
+
+	tags := make(map[string][]int, len(ti.ids))
+	for tag, ids := range ti.ids {
+		tags[tag] = append([]int(nil), ids...)
+	}
+
+	return tags
+}
+
+func readIds(tx storage.Tx, bucket, key string) (ids []int, err error) {
+	b, err := tx.Read(bucket, key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for i := 0; i+8 <= len(b); i += 8 {
+		ids = append(ids, int(ByteToUint64(b[i:i+8])))
+	}
+
+	return ids, nil
+}
+
+// removeId drops the id from a record of 8 byte ids, an empty record is
+// deleted
+func removeId(tx storage.Tx, bucket, key string, id int) error {
+	b, err := tx.Read(bucket, key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	filter := make([]byte, 0, len(b))
+	for i := 0; i+8 <= len(b); i += 8 {
+		if ByteToUint64(b[i:i+8]) != uint64(id) {
+			filter = append(filter, b[i:i+8]...)
+		}
+	}
+
+	if len(filter) == 0 {
+		return tx.Delete(bucket, key)
+	}
+
+	return tx.Write(bucket, key, filter)
+}
+
+// normalizeTag lower case words joined by "-", a tag is a storage key
+func normalizeTag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+
+	if tag == "" || len(tag) > maxTagLength || tag[0] == '.' || strings.ContainsAny(tag, "/\\\x00") {
+		return "", ErrInvalidTag
+	}
+
+	return tag, nil
+}
+
+// normalizeTags drops duplicates
+func normalizeTags(tags []string) (normalized []string, err error) {
+	for _, tag := range tags {
+		tag, err = normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !hasString(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+
+	if len(normalized) > maxTags {
+		return nil, ErrTooManyTags
+	}
+
+	return normalized, nil
+}
+
+// categoryTags the category as a list for TagIndex, none when empty
+func categoryTags(category string) []string {
+	if category == "" {
+		return nil
+	}
+	return []string{category}
+}
+
+var ErrInvalidTag = errors.New("invalid tag")
+var ErrTooManyTags = errors.New("too many tags")
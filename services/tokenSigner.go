@@ -0,0 +1,244 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signing algorithms of session tokens
+const (
+	TokenAlgHS256 = "HS256"
+	TokenAlgEdDSA = "EdDSA"
+)
+
+// sessionKeysSecret name of the signing keys in the secrets bucket
+const sessionKeysSecret = "session-keys"
+
+// tokenSigner signs session tokens as JWTs and verifies them without
+// storage reads. A new key is made every rotation, old keys verify the
+// tokens they signed until those expire.
+type tokenSigner struct {
+	db       storage.Storage
+	alg      string
+	ttl      time.Duration
+	rotation time.Duration
+	keys     []*signingKey // newest first
+	m        sync.RWMutex
+}
+
+type signingKey struct {
+	Kid     string    `json:"kid"`
+	Alg     string    `json:"alg"`
+	Key     []byte    `json:"key"` // hmac secret or ed25519 private key
+	Created time.Time `json:"created"`
+}
+
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	SessionId string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	Expires   int64  `json:"exp"`
+}
+
+func newTokenSigner(db storage.Storage, alg string, ttl, rotation time.Duration) (*tokenSigner, error) {
+	if alg != TokenAlgHS256 && alg != TokenAlgEdDSA {
+		return nil, fmt.Errorf("unknown token alg %q", alg)
+	}
+
+	s := tokenSigner{
+		db:       db,
+		alg:      alg,
+		ttl:      ttl,
+		rotation: rotation,
+	}
+
+	b, err := db.Read(storage.Secrets, sessionKeysSecret)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &s.keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// rotate makes a new key when the newest one is old or of another alg,
+// and drops keys no live token was signed with
+func (s *tokenSigner) rotate(now time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	changed := false
+
+	if len(s.keys) == 0 || now.Sub(s.keys[0].Created) >= s.rotation || s.keys[0].Alg != s.alg {
+		key, err := newSigningKey(s.alg, now)
+		if err != nil {
+			return err
+		}
+		s.keys = append([]*signingKey{key}, s.keys...)
+		changed = true
+
+		log.Info().Str("kid", key.Kid).Str("alg", key.Alg).Msg("new session signing key")
+	}
+
+	// a key signs until the next one is made, its tokens live ttl longer
+	keep := s.keys[:1]
+	for i := 1; i < len(s.keys); i++ {
+		if now.Sub(s.keys[i-1].Created) > s.ttl {
+			changed = true
+			continue
+		}
+		keep = append(keep, s.keys[i])
+	}
+	s.keys = keep
+
+	if !changed {
+		return nil
+	}
+
+	b, err := json.Marshal(s.keys)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Write(storage.Secrets, sessionKeysSecret, b)
+}
+
+func newSigningKey(alg string, now time.Time) (*signingKey, error) {
+	kid, err := randomHex(4)
+	if err != nil {
+		return nil, err
+	}
+
+	key := signingKey{Kid: kid, Alg: alg, Created: now}
+
+	switch alg {
+	case TokenAlgEdDSA:
+		_, key.Key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		key.Key = make([]byte, 32)
+		_, err = rand.Read(key.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (s *tokenSigner) sign(claims sessionClaims) (string, error) {
+	s.m.RLock()
+	key := s.keys[0]
+	s.m.RUnlock()
+
+	header, err := json.Marshal(map[string]string{"alg": key.Alg, "kid": key.Kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(key.signature(signed)), nil
+}
+
+// verify checks the signature and expiry, the claims of an expired token
+// come with ErrTokenExpired
+func (s *tokenSigner) verify(token string, now time.Time) (*sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	key := s.key(header.Kid)
+	if key == nil || key.Alg != header.Alg {
+		return nil, ErrTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify(parts[0]+"."+parts[1], sig) {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims sessionClaims
+
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	// the claims still name the session, to log it out
+	if now.Unix() >= claims.Expires {
+		return &claims, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
+
+func (s *tokenSigner) key(kid string) *signingKey {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for _, key := range s.keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *signingKey) signature(signed string) []byte {
+	if k.Alg == TokenAlgEdDSA {
+		return ed25519.Sign(ed25519.PrivateKey(k.Key), []byte(signed))
+	}
+
+	mac := hmac.New(sha256.New, k.Key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func (k *signingKey) verify(signed string, sig []byte) bool {
+	if k.Alg == TokenAlgEdDSA {
+		public := ed25519.PrivateKey(k.Key).Public().(ed25519.PublicKey)
+		return ed25519.Verify(public, []byte(signed), sig)
+	}
+
+	return hmac.Equal(sig, k.signature(signed))
+}
+
+var ErrTokenInvalid = errors.New("invalid token")
@@ -2,19 +2,79 @@ package services
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"os"
+	"encoding/json"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Tokens session tokens, a token expires when it is not used for ttl.
+//
+// With a signer tokens are signed JWTs checked without storage reads.
+// They expire ttl after login, and logouts go to a revocation list kept
+// in memory. Records keyed by the session id still back the sessions
+// list.
 type Tokens struct {
+	db        storage.Storage
+	ttl       time.Duration
+	closeChan chan chan struct{}
+
+	signer   *tokenSigner
+	revoked  map[string]int64 // [session id] expiry
+	revokedM sync.RWMutex
 }
 
-func NewTokens() *Tokens {
-	os.MkdirAll("db/tokens/", os.ModePerm)
-	return &Tokens{}
+func NewTokens(db storage.Storage, ttl, sweepInterval time.Duration) (*Tokens, error) {
+	return newTokens(db, ttl, sweepInterval, nil)
 }
 
-func (t *Tokens) MakeToken(email string) (token string, err error) {
+// NewSignedTokens alg is HS256 or EdDSA, signing keys are replaced every
+// rotation
+func NewSignedTokens(db storage.Storage, ttl, sweepInterval time.Duration, alg string, rotation time.Duration) (*Tokens, error) {
+	signer, err := newTokenSigner(db, alg, ttl, rotation)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTokens(db, ttl, sweepInterval, signer)
+}
+
+func newTokens(db storage.Storage, ttl, sweepInterval time.Duration, signer *tokenSigner) (*Tokens, error) {
+	t := Tokens{
+		db:        db,
+		ttl:       ttl,
+		closeChan: make(chan chan struct{}),
+		signer:    signer,
+		revoked:   make(map[string]int64),
+	}
+
+	err := t.indexTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	if signer != nil {
+		err = t.loadRevoked()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go t.janitor(sweepInterval)
+
+	return &t, nil
+}
+
+// MakeToken userAgent and ip are only shown in the sessions list
+func (t *Tokens) MakeToken(email, userAgent, ip string) (token string, err error) {
 	b := make([]byte, 20)
 
 	_, err = rand.Read(b)
@@ -22,16 +82,44 @@ func (t *Tokens) MakeToken(email string) (token string, err error) {
 		return "", err
 	}
 
-	token = hex.EncodeToString(b)
+	// the record key, the token itself or the session id of a signed one
+	key := hex.EncodeToString(b)
+	token = key
 
-	f, err := os.Create("db/tokens/" + token)
-	if err != nil {
-		return "", err
+	now := time.Now()
+
+	if t.signer != nil {
+		token, err = t.signer.sign(sessionClaims{
+			Subject:   email,
+			SessionId: key,
+			IssuedAt:  now.Unix(),
+			Expires:   now.Add(t.ttl).Unix(),
+		})
+		if err != nil {
+			return "", err
+		}
 	}
 
-	defer f.Close()
+	err = t.db.Update(func(tx storage.Tx) error {
+		err := t.writeToken(tx, key, &types.Token{
+			Email:     email,
+			Created:   now,
+			LastSeen:  now,
+			UserAgent: userAgent,
+			Signed:    t.signer != nil,
+			IP:        ip,
+		})
+		if err != nil {
+			return err
+		}
 
-	_, err = f.Write([]byte(email))
+		tokens, err := userTokens(tx, email)
+		if err != nil {
+			return err
+		}
+
+		return setUserTokens(tx, email, append(tokens, key))
+	})
 	if err != nil {
 		return "", err
 	}
@@ -40,19 +128,549 @@ func (t *Tokens) MakeToken(email string) (token string, err error) {
 }
 
 func (t *Tokens) DeleteToken(token string) error {
-	err := os.Remove("db/tokens/" + token)
+	key, err := t.key(token)
 	if err != nil {
 		return err
 	}
 
-	return err
+	return t.db.Update(func(tx storage.Tx) error {
+		record, err := readToken(tx, key)
+		if err != nil {
+			return err
+		}
+
+		err = t.revoke(tx, key, record)
+		if err != nil {
+			return err
+		}
+
+		return deleteToken(tx, key, record.Email)
+	})
 }
 
-func (t *Tokens) EmailFromToken(token string) (email string, err error) {
-	b, err := os.ReadFile("db/tokens/" + token)
+// EmailFromToken owner of a not expired token, using the token renews it.
+// A signed token is checked in memory and is not renewed.
+func (t *Tokens) EmailFromToken(token string) (string, error) {
+	if t.signer != nil {
+		claims, err := t.signer.verify(token, time.Now())
+		if err != nil {
+			return "", err
+		}
+
+		t.revokedM.RLock()
+		_, revoked := t.revoked[claims.SessionId]
+		t.revokedM.RUnlock()
+
+		if revoked {
+			return "", ErrTokenInvalid
+		}
+
+		return claims.Subject, nil
+	}
+
+	// most requests only read, the write is left for expiry and renewal
+	now := time.Now()
+
+	record, err := readToken(t.db, token)
+	if err == nil {
+		err = t.checkToken(record, now)
+	}
+	if err == nil && t.needsRenewal(record, now) {
+		err = t.db.Update(func(tx storage.Tx) error {
+			record, err := readToken(tx, token)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+
+			err = t.checkToken(record, now)
+			if err != nil {
+				return err
+			}
+
+			// another request may have renewed it meanwhile
+			if !t.needsRenewal(record, now) {
+				return nil
+			}
+
+			upgradeToken(record, now)
+			record.LastSeen = now
+
+			return t.writeToken(tx, token, record)
+		})
+	}
+	if errors.Is(err, ErrTokenExpired) {
+		// the janitor would get it later anyway, signed tokens return above
+		delErr := t.DeleteToken(token)
+		if delErr != nil && !errors.Is(delErr, fs.ErrNotExist) {
+			log.Error().Err(delErr).Msg("delete expired token")
+		}
+	}
 	if err != nil {
 		return "", err
 	}
 
-	return string(b), err
+	return record.Email, nil
+}
+
+// checkToken an unsigned token that has not expired
+func (t *Tokens) checkToken(record *types.Token, now time.Time) error {
+	// the session id is readable in a signed token, it is not a token
+	if record.Signed {
+		return fs.ErrNotExist
+	}
+
+	if t.expired(record, now) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// needsRenewal LastSeen is not written on every request, a tenth of ttl is
+// precise enough
+func (t *Tokens) needsRenewal(record *types.Token, now time.Time) bool {
+	return record.Created.IsZero() || now.Sub(record.LastSeen) > t.ttl/10
+}
+
+// Sessions not expired tokens of the user, newest first. current is the
+// token of the request, its session is marked.
+func (t *Tokens) Sessions(email, current string) (sessions []types.Session, err error) {
+	tokens, err := userTokens(t.db, email)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err = t.key(current)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, token := range tokens {
+		record, err := readToken(t.db, token)
+		if err != nil {
+			// deleted after the index was read
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		if t.expired(record, now) {
+			continue
+		}
+
+		sessions = append(sessions, types.Session{
+			Id:        SessionId(token),
+			Created:   record.Created,
+			LastSeen:  record.LastSeen,
+			UserAgent: record.UserAgent,
+			IP:        record.IP,
+			Current:   token == current,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+
+	return sessions, nil
+}
+
+// DeleteSession deletes a token of the user by its session id
+func (t *Tokens) DeleteSession(email, id string) error {
+	return t.db.Update(func(tx storage.Tx) error {
+		tokens, err := userTokens(tx, email)
+		if err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			if SessionId(token) != id {
+				continue
+			}
+
+			record, err := readToken(tx, token)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if record != nil {
+				err = t.revoke(tx, token, record)
+				if err != nil {
+					return err
+				}
+			}
+
+			return deleteToken(tx, token, email)
+		}
+
+		return ErrSessionNotFound
+	})
+}
+
+// DeleteSessions deletes every token of the user
+func (t *Tokens) DeleteSessions(email string) (deleted int, err error) {
+	err = t.db.Update(func(tx storage.Tx) error {
+		tokens, err := userTokens(tx, email)
+		if err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			record, err := readToken(tx, token)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+
+			err = t.revoke(tx, token, record)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Delete(storage.Tokens, token)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		deleted = len(tokens)
+
+		return setUserTokens(tx, email, nil)
+	})
+
+	return deleted, err
+}
+
+// SessionId names a token in the sessions list without revealing it
+func SessionId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sweep deletes expired tokens and revocations, and rotates the signing key
+func (t *Tokens) Sweep() (deleted int, err error) {
+	keys, err := t.db.Keys(storage.Tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	if t.signer != nil {
+		err = t.signer.rotate(now)
+		if err != nil {
+			return 0, err
+		}
+
+		err = t.sweepRevoked(now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, key := range keys {
+		err = t.db.Update(func(tx storage.Tx) error {
+			record, err := readToken(tx, key)
+			if err != nil {
+				// deleted by logout after Keys
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+
+			if record.Created.IsZero() {
+				upgradeToken(record, now)
+				return t.writeToken(tx, key, record)
+			}
+
+			if !t.expired(record, now) {
+				return nil
+			}
+
+			deleted++
+
+			return deleteToken(tx, key, record.Email)
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// Close stops the janitor
+func (t *Tokens) Close() {
+	done := make(chan struct{})
+	t.closeChan <- done
+	<-done
+}
+
+func (t *Tokens) janitor(interval time.Duration) {
+	tic := time.NewTicker(interval)
+	defer tic.Stop()
+
+	for {
+		select {
+		case <-tic.C:
+			deleted, err := t.Sweep()
+			if err != nil {
+				log.Error().Err(err).Msg("sweep tokens")
+			}
+			if deleted != 0 {
+				log.Info().Msgf("deleted %d expired tokens", deleted)
+			}
+		case done := <-t.closeChan:
+			close(done)
+			return
+		}
+	}
+}
+
+// indexTokens builds the index by email of tokens made before it existed,
+// it runs while the index is empty
+func (t *Tokens) indexTokens() error {
+	indexed, err := t.db.Keys(storage.UserTokens)
+	if err != nil || len(indexed) != 0 {
+		return err
+	}
+
+	keys, err := t.db.Keys(storage.Tokens)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	return t.db.Update(func(tx storage.Tx) error {
+		byEmail := make(map[string][]string)
+
+		for _, key := range keys {
+			record, err := readToken(tx, key)
+			if err != nil {
+				return err
+			}
+			byEmail[record.Email] = append(byEmail[record.Email], key)
+		}
+
+		for email, tokens := range byEmail {
+			err := setUserTokens(tx, email, tokens)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Info().Msgf("indexed %d tokens of %d users", len(keys), len(byEmail))
+
+		return nil
+	})
+}
+
+// key the record key of a token, the session id of a signed one
+func (t *Tokens) key(token string) (string, error) {
+	if t.signer == nil {
+		return token, nil
+	}
+
+	claims, err := t.signer.verify(token, time.Now())
+	if err != nil && !errors.Is(err, ErrTokenExpired) {
+		return "", fs.ErrNotExist
+	}
+
+	return claims.SessionId, nil
+}
+
+// revoke a signed token stays valid until its expiry, its session id is
+// listed until then
+func (t *Tokens) revoke(tx storage.Tx, key string, record *types.Token) error {
+	if !record.Signed {
+		return nil
+	}
+
+	expires := record.Created.Add(t.ttl).Unix()
+
+	err := tx.Write(storage.RevokedTokens, key, []byte(strconv.FormatInt(expires, 10)))
+	if err != nil {
+		return err
+	}
+
+	// set before commit, a revocation rolled back is harmless as the
+	// record is kept and the user can log out again
+	t.revokedM.Lock()
+	t.revoked[key] = expires
+	t.revokedM.Unlock()
+
+	return nil
+}
+
+func (t *Tokens) loadRevoked() error {
+	keys, err := t.db.Keys(storage.RevokedTokens)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		b, err := t.db.Read(storage.RevokedTokens, key)
+		if err != nil {
+			return err
+		}
+
+		expires, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		t.revoked[key] = expires
+	}
+
+	return nil
+}
+
+// sweepRevoked drops revocations of tokens that expired anyway
+func (t *Tokens) sweepRevoked(now time.Time) error {
+	var expired []string
+
+	t.revokedM.RLock()
+	for key, expires := range t.revoked {
+		if now.Unix() >= expires {
+			expired = append(expired, key)
+		}
+	}
+	t.revokedM.RUnlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	err := t.db.Update(func(tx storage.Tx) error {
+		for _, key := range expired {
+			err := tx.Delete(storage.RevokedTokens, key)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.revokedM.Lock()
+	for _, key := range expired {
+		delete(t.revoked, key)
+	}
+	t.revokedM.Unlock()
+
+	return nil
+}
+
+func (t *Tokens) expired(record *types.Token, now time.Time) bool {
+	// made before expiry, see readToken
+	if record.Created.IsZero() {
+		return false
+	}
+
+	return now.Sub(record.LastSeen) > t.ttl
 }
+
+// upgradeToken a token made before expiry is counted as made now,
+// so the upgrade does not log everyone out
+func upgradeToken(record *types.Token, now time.Time) {
+	if record.Created.IsZero() {
+		record.Created = now
+		record.LastSeen = now
+	}
+}
+
+func (t *Tokens) writeToken(tx storage.Tx, token string, record *types.Token) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.Tokens, token, b)
+}
+
+// readToken tokens made before expiry hold just the email, they come
+// back without timestamps
+func readToken(tx storage.Tx, token string) (*types.Token, error) {
+	b, err := tx.Read(storage.Tokens, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var record types.Token
+
+	if !json.Valid(b) {
+		return &types.Token{Email: string(b)}, nil
+	}
+
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// deleteToken deletes the token and its index entry
+func deleteToken(tx storage.Tx, token, email string) error {
+	err := tx.Delete(storage.Tokens, token)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	tokens, err := userTokens(tx, email)
+	if err != nil {
+		return err
+	}
+
+	filter := tokens[:0]
+	for _, t := range tokens {
+		if t != token {
+			filter = append(filter, t)
+		}
+	}
+
+	return setUserTokens(tx, email, filter)
+}
+
+func userTokens(tx storage.Tx, email string) (tokens []string, err error) {
+	b, err := tx.Read(storage.UserTokens, email)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func setUserTokens(tx storage.Tx, email string, tokens []string) error {
+	if len(tokens) == 0 {
+		err := tx.Delete(storage.UserTokens, email)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	return tx.Write(storage.UserTokens, email, b)
+}
+
+var ErrTokenExpired = errors.New("token expired")
+var ErrSessionNotFound = errors.New("session not found")
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"testing"
+	"time"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	db := storage.NewMemory()
+
+	tokens, err := NewTokens(db, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+
+	token, err := tokens.MakeToken("user@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// made before expiry existed
+	err = db.Write(storage.Tokens, "legacy", []byte("old@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email, err := tokens.EmailFromToken("legacy")
+	if err != nil || email != "old@example.com" {
+		t.Fatalf("legacy token: %q %v", email, err)
+	}
+
+	record, err := readToken(db, "legacy")
+	if err != nil || record.Created.IsZero() {
+		t.Fatalf("legacy token is not upgraded: %+v %v", record, err)
+	}
+
+	// not used for longer than ttl
+	record, err = readToken(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.LastSeen = time.Now().Add(-2 * time.Hour)
+
+	err = tokens.writeToken(db, token, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.EmailFromToken(token)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expired token is accepted: %v", err)
+	}
+
+	_, err = db.Read(storage.Tokens, token)
+	if err == nil {
+		t.Error("expired token is not deleted")
+	}
+
+	// renewed on use, the sweep keeps it
+	record, _ = readToken(db, "legacy")
+	record.LastSeen = time.Now().Add(-50 * time.Minute)
+	_ = tokens.writeToken(db, "legacy", record)
+
+	_, err = tokens.EmailFromToken("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, _ := tokens.MakeToken("stale@example.com", "", "")
+	record, _ = readToken(db, stale)
+	record.LastSeen = time.Now().Add(-61 * time.Minute)
+	_ = tokens.writeToken(db, stale, record)
+
+	deleted, err := tokens.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("swept %d tokens, want 1", deleted)
+	}
+
+	_, err = tokens.EmailFromToken("legacy")
+	if err != nil {
+		t.Errorf("renewed token is swept: %v", err)
+	}
+}
+
+// updateCounter counts the write transactions
+type updateCounter struct {
+	storage.Storage
+	updates int
+}
+
+func (u *updateCounter) Update(fn func(tx storage.Tx) error) error {
+	u.updates++
+	return u.Storage.Update(fn)
+}
+
+func TestTokenReadOnly(t *testing.T) {
+	db := &updateCounter{Storage: storage.NewMemory()}
+
+	tokens, err := NewTokens(db, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+
+	token, err := tokens.MakeToken("user@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.updates = 0
+	for i := 0; i < 3; i++ {
+		email, err := tokens.EmailFromToken(token)
+		if err != nil || email != "user@example.com" {
+			t.Fatalf("fresh token: %q %v", email, err)
+		}
+	}
+	if db.updates != 0 {
+		t.Errorf("fresh token is written %d times", db.updates)
+	}
+
+	// older than a tenth of ttl
+	record, _ := readToken(db, token)
+	record.LastSeen = time.Now().Add(-10 * time.Minute)
+	_ = tokens.writeToken(db, token, record)
+
+	db.updates = 0
+	_, err = tokens.EmailFromToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.updates != 1 {
+		t.Errorf("stale token is written %d times, want 1", db.updates)
+	}
+
+	record, _ = readToken(db, token)
+	if time.Since(record.LastSeen) > time.Minute {
+		t.Errorf("LastSeen is not renewed: %v", record.LastSeen)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db := storage.NewMemory()
+
+	// made before the index by email existed
+	err := db.Write(storage.Tokens, "legacy", []byte("user@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := NewTokens(db, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Close()
+
+	phone, _ := tokens.MakeToken("user@example.com", "phone", "10.0.0.1")
+	laptop, _ := tokens.MakeToken("user@example.com", "laptop", "10.0.0.2")
+	other, _ := tokens.MakeToken("other@example.com", "", "")
+
+	sessions, err := tokens.Sessions("user@example.com", laptop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, want 3", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.Id == SessionId(laptop)) {
+			t.Errorf("session %s current %v", s.Id, s.Current)
+		}
+	}
+
+	// an id of another user is not found
+	err = tokens.DeleteSession("user@example.com", SessionId(other))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("deleted a session of another user: %v", err)
+	}
+
+	err = tokens.DeleteSession("user@example.com", SessionId(phone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokens.EmailFromToken(phone)
+	if err == nil {
+		t.Error("deleted session token is accepted")
+	}
+
+	deleted, err := tokens.DeleteSessions("user@example.com")
+	if err != nil || deleted != 2 {
+		t.Fatalf("deleted %d sessions: %v", deleted, err)
+	}
+
+	sessions, _ = tokens.Sessions("user@example.com", "")
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions left", len(sessions))
+	}
+
+	_, err = tokens.EmailFromToken(other)
+	if err != nil {
+		t.Errorf("token of another user is deleted: %v", err)
+	}
+}
+
+func TestSignedTokens(t *testing.T) {
+	for _, alg := range []string{TokenAlgHS256, TokenAlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			db := storage.NewMemory()
+
+			tokens, err := NewSignedTokens(db, time.Hour, time.Hour, alg, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tokens.Close()
+
+			token, err := tokens.MakeToken("user@example.com", "phone", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _ := tokens.MakeToken("user@example.com", "laptop", "")
+
+			email, err := tokens.EmailFromToken(token)
+			if err != nil || email != "user@example.com" {
+				t.Fatalf("signed token: %q %v", email, err)
+			}
+
+			// a char inside the signature, the last ones carry padding bits
+			i, c := len(token)-5, "A"
+			if token[i] == 'A' {
+				c = "B"
+			}
+			_, err = tokens.EmailFromToken(token[:i] + c + token[i+1:])
+			if !errors.Is(err, ErrTokenInvalid) {
+				t.Errorf("tampered token is accepted: %v", err)
+			}
+
+			sessions, err := tokens.Sessions("user@example.com", token)
+			if err != nil || len(sessions) != 2 {
+				t.Fatalf("got %d sessions: %v", len(sessions), err)
+			}
+
+			// the session id is readable in the token, a file token it is not
+			claims, _ := tokens.signer.verify(token, time.Now())
+			files, _ := NewTokens(db, time.Hour, time.Hour)
+			defer files.Close()
+			_, err = files.EmailFromToken(claims.SessionId)
+			if err == nil {
+				t.Error("session id of a signed token is accepted as a file token")
+			}
+
+			// old keys verify until their tokens expire
+			later := time.Now().Add(25 * time.Hour)
+			err = tokens.signer.rotate(later)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens.signer.keys) != 2 {
+				t.Fatalf("got %d keys after rotation", len(tokens.signer.keys))
+			}
+			_, err = tokens.EmailFromToken(token)
+			if err != nil {
+				t.Errorf("token of the previous key: %v", err)
+			}
+
+			err = tokens.DeleteToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tokens.EmailFromToken(token)
+			if !errors.Is(err, ErrTokenInvalid) {
+				t.Errorf("logged out token is accepted: %v", err)
+			}
+
+			// revocations and keys outlive a restart
+			restarted, err := NewSignedTokens(db, time.Hour, time.Hour, alg, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer restarted.Close()
+
+			_, err = restarted.EmailFromToken(token)
+			if !errors.Is(err, ErrTokenInvalid) {
+				t.Errorf("logged out token is accepted after restart: %v", err)
+			}
+			_, err = restarted.EmailFromToken(other)
+			if err != nil {
+				t.Errorf("token is rejected after restart: %v", err)
+			}
+
+			err = restarted.signer.rotate(later.Add(2 * time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(restarted.signer.keys) != 1 {
+				t.Errorf("got %d keys, the old one is not dropped", len(restarted.signer.keys))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// test vectors of RFC 6238 appendix B, sha1 key
+func TestTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for ts, want := range vectors {
+		got := hotp(key, uint64(totpStep(time.Unix(ts, 0))), 8)
+		if got != want {
+			t.Errorf("%d: got %s, want %s", ts, got, want)
+		}
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	code := hotp(key, uint64(totpStep(now)), totpDigits)
+
+	step, ok := checkTOTP(secret, code, now.Add(totpPeriod*time.Second), 0)
+	if !ok {
+		t.Fatal("code of the previous step is refused")
+	}
+
+	_, ok = checkTOTP(secret, code, now, step)
+	if ok {
+		t.Error("used code is accepted again")
+	}
+
+	_, ok = checkTOTP(secret, code, now.Add(3*totpPeriod*time.Second), 0)
+	if ok {
+		t.Error("old code is accepted")
+	}
+}
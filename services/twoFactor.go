@@ -0,0 +1,249 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/TokDenis/micro-blog/storage"
+	"github.com/TokDenis/micro-blog/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recoveryCodesCount = 10
+	// preAuthAttempts codes tried with one pre-auth token
+	preAuthAttempts = 5
+)
+
+// EnrollTOTP makes a new secret, it is used after ConfirmTOTP
+func (a *Auth) EnrollTOTP(email, issuer string) (*types.TOTPEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if user.TOTPEnabled {
+			return ErrTwoFactorEnabled
+		}
+
+		user.TOTPSecret = secret
+
+		return a.writeUser(tx, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.TOTPEnrollment{Secret: secret, URI: totpURI(issuer, email, secret)}, nil
+}
+
+// ConfirmTOTP turns two factor authentication on, the recovery codes are
+// returned only here
+func (a *Auth) ConfirmTOTP(email, code string) (recovery []string, err error) {
+	err = a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		if user.TOTPEnabled || user.TOTPSecret == "" {
+			return ErrTwoFactorNotEnrolled
+		}
+
+		step, ok := checkTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return ErrIncorrectCode
+		}
+
+		recovery, user.RecoveryCodes, err = newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+
+		return a.writeUser(tx, user)
+	})
+
+	return recovery, err
+}
+
+// DisableTOTP turns two factor authentication off, it takes a code like a
+// login does
+func (a *Auth) DisableTOTP(email, code string) error {
+	return a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		err = checkSecondFactor(user, code)
+		if err != nil {
+			return err
+		}
+
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+
+		return a.writeUser(tx, user)
+	})
+}
+
+// CheckSecondFactor accepts a totp code or an unused recovery code
+func (a *Auth) CheckSecondFactor(email, code string) error {
+	return a.db.Update(func(tx storage.Tx) error {
+		user, err := a.readUser(tx, email)
+		if err != nil {
+			return err
+		}
+
+		err = checkSecondFactor(user, code)
+		if err != nil {
+			return err
+		}
+
+		return a.writeUser(tx, user)
+	})
+}
+
+// checkSecondFactor marks the code used in user, the caller saves it
+func checkSecondFactor(user *types.User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	step, ok := checkTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if ok {
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrIncorrectCode
+}
+
+// newRecoveryCodes codes like "k3f9a-x2m7q" and their hashes. They are
+// random enough for sha256, a slow hash would make login by code slow.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 10)
+
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// PreAuth logins that passed the password check and wait for the second
+// factor. They live in memory, a restart just asks for the password again.
+type PreAuth struct {
+	ttl    time.Duration
+	logins map[string]*preAuthLogin
+	m      sync.Mutex
+}
+
+type preAuthLogin struct {
+	email    string
+	expires  time.Time
+	attempts int
+}
+
+func NewPreAuth(ttl time.Duration) *PreAuth {
+	return &PreAuth{
+		ttl:    ttl,
+		logins: make(map[string]*preAuthLogin),
+	}
+}
+
+func (p *PreAuth) Make(email string) (*types.PreAuth, error) {
+	b := make([]byte, 20)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	token := hex.EncodeToString(b)
+	now := time.Now()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for t, login := range p.logins {
+		if now.After(login.expires) {
+			delete(p.logins, t)
+		}
+	}
+
+	login := &preAuthLogin{email: email, expires: now.Add(p.ttl)}
+	p.logins[token] = login
+
+	return &types.PreAuth{PreAuthToken: token, Expires: login.expires}, nil
+}
+
+// Email owner of the token, every call counts as an attempt
+func (p *PreAuth) Email(token string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	login, ok := p.logins[token]
+	if !ok || time.Now().After(login.expires) {
+		delete(p.logins, token)
+		return "", ErrPreAuthNotFound
+	}
+
+	login.attempts++
+	if login.attempts >= preAuthAttempts {
+		delete(p.logins, token)
+	}
+
+	return login.email, nil
+}
+
+func (p *PreAuth) Delete(token string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.logins, token)
+}
+
+var ErrTwoFactorEnabled = errors.New("two factor authentication is already on")
+var ErrTwoFactorNotEnrolled = errors.New("two factor authentication is off")
+var ErrTwoFactorRequired = errors.New("two factor authentication is required")
+var ErrIncorrectCode = errors.New("incorrect code")
+var ErrPreAuthNotFound = errors.New("pre-auth token not found")
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt keeps all buckets in a single bbolt file
+type Bolt struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range Buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+func (s *Bolt) Read(bucket, key string) (value []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value, err = boltTx{tx: tx}.Read(bucket, key)
+		return err
+	})
+	return value, err
+}
+
+func (s *Bolt) Write(bucket, key string, value []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Write(bucket, key, value)
+	})
+}
+
+func (s *Bolt) Append(bucket, key string, value []byte) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Append(bucket, key, value)
+	})
+}
+
+func (s *Bolt) Delete(bucket, key string) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Delete(bucket, key)
+	})
+}
+
+func (s *Bolt) Keys(bucket string) (keys []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		keys, err = boltTx{tx: tx}.Keys(bucket)
+		return err
+	})
+	return keys, err
+}
+
+func (s *Bolt) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+func (t boltTx) Read(bucket, key string) ([]byte, error) {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	// v is only valid until the transaction ends
+	return append([]byte(nil), v...), nil
+}
+
+func (t boltTx) Write(bucket, key string, value []byte) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), value)
+}
+
+func (t boltTx) Append(bucket, key string, value []byte) error {
+	old, err := t.Read(bucket, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return t.Write(bucket, key, append(old, value...))
+}
+
+func (t boltTx) Delete(bucket, key string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil || b.Get([]byte(key)) == nil {
+		return fs.ErrNotExist
+	}
+
+	return b.Delete([]byte(key))
+}
+
+func (t boltTx) Keys(bucket string) ([]string, error) {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, nil
+	}
+
+	var keys []string
+	err := b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+
+	return keys, err
+}
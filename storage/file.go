@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// File one file per record, db/<bucket>/<key>.
+// Every record is replaced with write-temp-fsync-rename, so a crash leaves
+// either the old or the new version of it. Update calls are serialized but
+// not atomic, a failed one may leave part of its writes behind.
+type File struct {
+	root string
+	m    sync.Mutex
+}
+
+type fileTx struct {
+	f *File
+}
+
+func NewFile(root string) (*File, error) {
+	for _, bucket := range Buckets {
+		err := os.MkdirAll(filepath.Join(root, bucket), os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f := &File{root: root}
+
+	quarantined, err := f.Recover()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range quarantined {
+		log.Warn().Str("path", path).Msg("damaged record moved to quarantine")
+	}
+
+	return f, nil
+}
+
+func (f *File) Read(bucket, key string) ([]byte, error) {
+	return f.read(bucket, key)
+}
+
+func (f *File) Write(bucket, key string, value []byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.write(bucket, key, value)
+}
+
+func (f *File) Append(bucket, key string, value []byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.append(bucket, key, value)
+}
+
+func (f *File) Delete(bucket, key string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.delete(bucket, key)
+}
+
+func (f *File) Keys(bucket string) ([]string, error) {
+	return f.keys(bucket)
+}
+
+func (f *File) Update(fn func(tx Tx) error) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return fn(fileTx{f: f})
+}
+
+func (f *File) Close() error {
+	return nil
+}
+
+func (tx fileTx) Read(bucket, key string) ([]byte, error) {
+	return tx.f.read(bucket, key)
+}
+
+func (tx fileTx) Write(bucket, key string, value []byte) error {
+	return tx.f.write(bucket, key, value)
+}
+
+func (tx fileTx) Append(bucket, key string, value []byte) error {
+	return tx.f.append(bucket, key, value)
+}
+
+func (tx fileTx) Delete(bucket, key string) error {
+	return tx.f.delete(bucket, key)
+}
+
+func (tx fileTx) Keys(bucket string) ([]string, error) {
+	return tx.f.keys(bucket)
+}
+
+func (f *File) path(bucket, key string) (string, error) {
+	err := checkKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, bucket, key), nil
+}
+
+func (f *File) read(bucket, key string) ([]byte, error) {
+	path, err := f.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path)
+}
+
+func (f *File) write(bucket, key string, value []byte) error {
+	path, err := f.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(path, value)
+}
+
+func (f *File) append(bucket, key string, value []byte) error {
+	path, err := f.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return writeAtomic(path, append(old, value...))
+}
+
+func (f *File) delete(bucket, key string) error {
+	path, err := f.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func (f *File) keys(bucket string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(f.root, bucket))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if entry.IsDir() || checkKey(entry.Name()) != nil {
+			continue
+		}
+		keys = append(keys, entry.Name())
+	}
+
+	return keys, nil
+}
+
+// Recover moves leftover temporary files and records that can not be
+// parsed to db/quarantine/<bucket>/, so one damaged file does not stop the
+// blog from starting.
+func (f *File) Recover() (quarantined []string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for _, bucket := range Buckets {
+		dir := filepath.Join(f.root, bucket)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return quarantined, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+
+			if checkKey(entry.Name()) == nil {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return quarantined, err
+				}
+				if isValidRecord(bucket, b) {
+					continue
+				}
+			}
+
+			to := filepath.Join(f.root, Quarantine, bucket, entry.Name()+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+
+			err = os.MkdirAll(filepath.Dir(to), os.ModePerm)
+			if err != nil {
+				return quarantined, err
+			}
+
+			err = os.Rename(path, to)
+			if err != nil {
+				return quarantined, err
+			}
+
+			err = syncDir(dir)
+			if err != nil {
+				return quarantined, err
+			}
+
+			quarantined = append(quarantined, path)
+		}
+	}
+
+	return quarantined, nil
+}
+
+func isValidRecord(bucket string, b []byte) bool {
+	switch bucket {
+	case PostIndex, PostComments, PostTags, PostCategories:
+		return len(b)%8 == 0
+	case Tokens, CommentReactions, Secrets:
+		return len(b) != 0
+	default:
+		return json.Valid(b)
+	}
+}
+
+// writeAtomic replaces path with data, the file is never seen half-written
+func writeAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename or remove inside dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
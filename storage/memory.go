@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// Memory keeps records in maps, for tests
+type Memory struct {
+	buckets map[string]map[string][]byte
+	m       sync.RWMutex
+}
+
+type memoryTx struct {
+	s *Memory
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *Memory) Read(bucket, key string) ([]byte, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.read(bucket, key)
+}
+
+func (s *Memory) Write(bucket, key string, value []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.write(bucket, key, value)
+}
+
+func (s *Memory) Append(bucket, key string, value []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.append(bucket, key, value)
+}
+
+func (s *Memory) Delete(bucket, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.delete(bucket, key)
+}
+
+func (s *Memory) Keys(bucket string) ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.keys(bucket)
+}
+
+func (s *Memory) Update(fn func(tx Tx) error) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// values are never changed in place, copying the maps is enough to roll back
+	snapshot := make(map[string]map[string][]byte, len(s.buckets))
+	for name, b := range s.buckets {
+		c := make(map[string][]byte, len(b))
+		for key, v := range b {
+			c[key] = v
+		}
+		snapshot[name] = c
+	}
+
+	err := fn(memoryTx{s: s})
+	if err != nil {
+		s.buckets = snapshot
+	}
+
+	return err
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
+
+func (tx memoryTx) Read(bucket, key string) ([]byte, error) {
+	return tx.s.read(bucket, key)
+}
+
+func (tx memoryTx) Write(bucket, key string, value []byte) error {
+	return tx.s.write(bucket, key, value)
+}
+
+func (tx memoryTx) Append(bucket, key string, value []byte) error {
+	return tx.s.append(bucket, key, value)
+}
+
+func (tx memoryTx) Delete(bucket, key string) error {
+	return tx.s.delete(bucket, key)
+}
+
+func (tx memoryTx) Keys(bucket string) ([]string, error) {
+	return tx.s.keys(bucket)
+}
+
+func (s *Memory) read(bucket, key string) ([]byte, error) {
+	v, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return append([]byte(nil), v...), nil
+}
+
+func (s *Memory) write(bucket, key string, value []byte) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.bucket(bucket)[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *Memory) append(bucket, key string, value []byte) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	b := s.bucket(bucket)
+	b[key] = append(append([]byte(nil), b[key]...), value...)
+	return nil
+}
+
+func (s *Memory) delete(bucket, key string) error {
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return fs.ErrNotExist
+	}
+
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *Memory) keys(bucket string) ([]string, error) {
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	// sorted like File and Bolt list them
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *Memory) bucket(name string) map[string][]byte {
+	b, ok := s.buckets[name]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[name] = b
+	}
+	return b
+}
@@ -0,0 +1,44 @@
+package storage
+
+// Migrate copies every known bucket from src to dst.
+// It refuses with ErrNotEmpty when dst already has posts or users, the
+// caller treats that as migrated to leave it enabled after the first run.
+func Migrate(src, dst Storage) (copied int, err error) {
+	for _, bucket := range []string{Posts, Users} {
+		keys, err := dst.Keys(bucket)
+		if err != nil {
+			return 0, err
+		}
+		if len(keys) != 0 {
+			return 0, ErrNotEmpty
+		}
+	}
+
+	err = dst.Update(func(tx Tx) error {
+		for _, bucket := range Buckets {
+			keys, err := src.Keys(bucket)
+			if err != nil {
+				return err
+			}
+
+			for _, key := range keys {
+				v, err := src.Read(bucket, key)
+				if err != nil {
+					return err
+				}
+
+				err = tx.Write(bucket, key, v)
+				if err != nil {
+					return err
+				}
+				copied++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return copied, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import "errors"
+
+// Tx reads and writes raw records grouped in buckets.
+// Missing records are reported as fs.ErrNotExist.
+type Tx interface {
+	Read(bucket, key string) ([]byte, error)
+	Write(bucket, key string, value []byte) error
+	Append(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	Keys(bucket string) ([]string, error)
+}
+
+// Storage is a Tx where every call is a transaction of its own.
+type Storage interface {
+	Tx
+	// Update runs fn in a single read-write transaction.
+	// If fn returns an error nothing it wrote is kept.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+const (
+	Posts     = "posts"
+	PostIndex = "posts-index/bytime"
+	// PostTags ids of the posts with a tag, key is the tag
+	PostTags = "posts-index/bytag"
+	// PostCategories ids of the posts of a category, key is the category
+	PostCategories = "posts-index/bycategory"
+	// PostRevisions versions of posts replaced by edits, key is
+	// <post id>-<revision>
+	PostRevisions = "post-revisions"
+	Stats         = "stats"
+	// Comments comments of a post in one json array, only read to migrate
+	// them to CommentRecords
+	Comments = "comments"
+	Users    = "users"
+	Tokens   = "tokens"
+
+	// Sequences counters of monotonic ids, key is the counter name
+	Sequences = "sequences"
+	// CommentIndex post id of every comment, key is the comment id
+	CommentIndex = "comments-index"
+	// CommentRecords one comment per record, key is the comment id
+	CommentRecords = "comment-records"
+	// PostComments ids of the comments of a post, key is the post id
+	PostComments = "posts-index/comments"
+	// CommentReactions key is <comment id>-<email>
+	CommentReactions = "comment-reactions"
+	// UserTokens tokens of a user in a json array, key is the email
+	UserTokens = "tokens-index/byemail"
+	// RevokedTokens logged out signed tokens, key is the session id and
+	// the value its expiry in unix seconds
+	RevokedTokens = "tokens-revoked"
+	// Secrets generated keys, key is the key name
+	Secrets = "secrets"
+	// LoginFailures failed logins of an account or an ip, key is
+	// account-<hash> or ip-<hash>
+	LoginFailures = "login-failures"
+	// AccessTokens personal access tokens, key is the token id
+	AccessTokens = "access-tokens"
+	// UserAccessTokens ids of the access tokens of a user in a json array,
+	// key is the email
+	UserAccessTokens = "access-tokens-index/byemail"
+
+	// ModerationLog audit records of moderations, key is the record id
+	ModerationLog = "moderation-log"
+
+	// Quarantine holds damaged records found by File.Recover
+	Quarantine = "quarantine"
+)
+
+// Buckets all known buckets
+var Buckets = []string{Posts, PostIndex, PostTags, PostCategories, PostRevisions, Stats, Comments, Users, Tokens, Sequences, CommentIndex, CommentRecords, PostComments, CommentReactions, UserTokens, RevokedTokens, Secrets, LoginFailures, AccessTokens, UserAccessTokens, ModerationLog}
+
+var ErrInvalidKey = errors.New("invalid key")
+var ErrNotEmpty = errors.New("storage is not empty")
+
+// checkKey keys starting with a dot are reserved for temporary files
+func checkKey(key string) error {
+	if key == "" || key[0] == '.' {
+		return ErrInvalidKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' || key[i] == '\\' || key[i] == 0 {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
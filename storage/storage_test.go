@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateRollback(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for name, db := range map[string]Storage{"memory": NewMemory(), "bolt": b} {
+		err := db.Write(Posts, "0", []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fail := errors.New("fail")
+
+		err = db.Update(func(tx Tx) error {
+			err := tx.Write(Posts, "0", []byte("new"))
+			if err != nil {
+				return err
+			}
+			err = tx.Append(PostIndex, "2021-01-01", []byte{0, 0, 0, 0, 0, 0, 0, 0})
+			if err != nil {
+				return err
+			}
+			return fail
+		})
+		if err != fail {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+
+		v, err := db.Read(Posts, "0")
+		if err != nil || string(v) != "old" {
+			t.Errorf("%s: post was not rolled back: %q %v", name, v, err)
+		}
+
+		_, err = db.Read(PostIndex, "2021-01-01")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: index was not rolled back: %v", name, err)
+		}
+	}
+}
+
+func TestKeysSorted(t *testing.T) {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	f, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, db := range map[string]Storage{"memory": NewMemory(), "bolt": b, "file": f} {
+		for _, key := range []string{"b", "c", "a", "d"} {
+			err := db.Write(Users, key, []byte("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys, err := db.Keys(Users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(keys, "") != "abcd" {
+			t.Errorf("%s: keys are not sorted: %v", name, keys)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = src.Write(Posts, "0", []byte(`{"id":0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.Append(PostIndex, "2021-01-01", []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := NewBolt(filepath.Join(t.TempDir(), "db.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	copied, err := Migrate(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 2 {
+		t.Errorf("unexpected copied %d", copied)
+	}
+
+	v, err := dst.Read(Posts, "0")
+	if err != nil || string(v) != `{"id":0}` {
+		t.Errorf("post was not migrated: %q %v", v, err)
+	}
+
+	_, err = Migrate(src, dst)
+	if err != ErrNotEmpty {
+		t.Errorf("second migration must be refused, got %v", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	root := t.TempDir()
+
+	db, err := NewFile(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Write(Posts, "0", []byte(`{"id":0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash in the middle of old style in place write and of a rename
+	err = os.WriteFile(filepath.Join(root, Posts, "1"), []byte(`{"id":1,"na`), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, Stats, ".0.123.tmp"), []byte(`{}`), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewFile(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.Keys(Posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "0" {
+		t.Errorf("damaged post is still listed: %v", keys)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, Quarantine, Posts))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("damaged post was not quarantined: %v", err)
+	}
+
+	entries, err = os.ReadDir(filepath.Join(root, Stats))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package types
+
+import "time"
+
+// scopes of personal access tokens
+const (
+	ScopePostsWrite    = "posts:write"
+	ScopeCommentsWrite = "comments:write"
+)
+
+// Scopes all known scopes
+var Scopes = []string{ScopePostsWrite, ScopeCommentsWrite}
+
+// AccessToken a personal access token as shown to its owner
+type AccessToken struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// NewAccessToken Token is shown only once, at creation
+type NewAccessToken struct {
+	Token string `json:"token"`
+	AccessToken
+}
+
+type AccessTokenReq struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
@@ -3,9 +3,28 @@ package types
 import "time"
 
 type Comment struct {
-	Id        int       `json:"id"`
-	UserName  string    `json:"user_name"`
-	Content   string    `json:"content"`
-	IsDeleted bool      `json:"is_deleted"`
-	Created   time.Time `json:"created"`
+	Id        int               `json:"id"`
+	ParentId  int               `json:"parent_id,omitempty"`
+	UserName  string            `json:"user_name"`
+	Content   string            `json:"content"`
+	IsDeleted bool              `json:"is_deleted"`
+	Created   time.Time         `json:"created"`
+	Edited    *time.Time        `json:"edited,omitempty"`
+	Deleted   *time.Time        `json:"deleted,omitempty"`
+	Reactions int               `json:"reactions"`
+	Revisions []CommentRevision `json:"revisions,omitempty"`
+}
+
+// CommentNode comment with its replies
+type CommentNode struct {
+	*Comment
+	Replies []*CommentNode `json:"replies,omitempty"`
+	// MoreReplies replies not included because of the depth or page limit
+	MoreReplies int `json:"more_replies,omitempty"`
+}
+
+// CommentRevision content of a comment before an edit
+type CommentRevision struct {
+	Content  string    `json:"content"`
+	Replaced time.Time `json:"replaced"`
 }
@@ -0,0 +1,45 @@
+package types
+
+import "time"
+
+// moderation actions
+const (
+	ModerationApprove = "approve"
+	// ModerationUnapprove sends a post back to the queue
+	ModerationUnapprove = "unapprove"
+	// ModerationReject hides a post until its author edits it
+	ModerationReject = "reject"
+)
+
+// PostModeration last decision on a post, shown to its author
+type PostModeration struct {
+	Action string    `json:"action"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+// ModerationReq the action is applied to every post of Ids
+type ModerationReq struct {
+	Ids    []int  `json:"ids"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// ModerationResult Status is the new status of the post, Error why it
+// was not moderated
+type ModerationResult struct {
+	Id     int    `json:"id"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ModerationRecord audit record of a moderation
+type ModerationRecord struct {
+	Id        int       `json:"id"`
+	PostId    int       `json:"post_id"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason,omitempty"`
+	Moderator string    `json:"moderator"`
+	At        time.Time `json:"at"`
+}
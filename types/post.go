@@ -2,6 +2,19 @@ package types
 
 import "time"
 
+// statuses of a post, only a published post is shown
+const (
+	// PostDraft seen only by its author
+	PostDraft = "draft"
+	// PostPending waits for a moderator
+	PostPending = "pending"
+	// PostScheduled approved, it is published at PublishAt
+	PostScheduled = "scheduled"
+	PostPublished = "published"
+	// PostRejected hidden until its author edits it
+	PostRejected = "rejected"
+)
+
 type Post struct {
 	Id         int       `json:"id"`
 	Name       string    `json:"name"`
@@ -11,10 +24,65 @@ type Post struct {
 	Created    time.Time `json:"created"`
 	Stats      *Stats    `json:"stats,omitempty"`
 	IsApproved bool      `json:"is_approved"`
+	Status     string    `json:"status"`
+	Tags       []string  `json:"tags,omitempty"`
+	Category   string    `json:"category,omitempty"`
+	// PublishAt when an approved post goes live, nil for at once
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// Published when the post went live first, the time index holds it
+	// under this day
+	Published *time.Time `json:"published,omitempty"`
+	// AuthorEmail owner of the post, empty for posts made before it was
+	// kept. Never served, see Post.ReadPost.
+	AuthorEmail string `json:"author_email,omitempty"`
+	// Revision number of this version, the original is 0
+	Revision int        `json:"revision,omitempty"`
+	Edited   *time.Time `json:"edited,omitempty"`
+	EditedBy string     `json:"edited_by,omitempty"`
+	// IsDeleted the post is in the trash until restored or purged
+	IsDeleted bool       `json:"is_deleted,omitempty"`
+	Deleted   *time.Time `json:"deleted,omitempty"`
+	// Moderation never served, see Post.ReadPost
+	Moderation *PostModeration `json:"moderation,omitempty"`
+}
+
+// PostRevision a version of a post replaced by an edit, never changed
+type PostRevision struct {
+	PostId    int    `json:"post_id"`
+	Revision  int    `json:"revision"`
+	Name      string `json:"name"`
+	ShortPost string `json:"short_post"`
+	MainPost  string `json:"main_post"`
+	// EditedBy name of who wrote this version
+	EditedBy string `json:"edited_by"`
+	// Created when this version was written
+	Created time.Time `json:"created"`
+}
+
+// PostDiff line changes of every field between two revisions
+type PostDiff struct {
+	PostId    int        `json:"post_id"`
+	From      int        `json:"from"`
+	To        int        `json:"to"`
+	Name      []DiffLine `json:"name"`
+	ShortPost []DiffLine `json:"short_post"`
+	MainPost  []DiffLine `json:"main_post"`
+}
+
+// TagCount published posts with the tag or of the category
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// DiffLine Op is "=" for a kept line, "-" for a removed and "+" for an added one
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
 }
 
 func (p *Post) IsValid() bool {
-	return p.IsApproved
+	return p.Status == PostPublished && !p.IsDeleted
 }
 
 type Stats struct {
@@ -1,9 +1,18 @@
 package types
 
+import "time"
+
 type NewPostReq struct {
 	Name      string `json:"name"`
 	ShortPost string `json:"short_post"`
 	MainPost  string `json:"main_post"`
+	// Tags and Category are normalized, see services.normalizeTag
+	Tags     []string `json:"tags"`
+	Category string   `json:"category"`
+	// Draft keeps the post from moderators, an edit without it submits a draft
+	Draft bool `json:"draft"`
+	// PublishAt publishes the post later once it is approved
+	PublishAt *time.Time `json:"publish_at,omitempty"`
 }
 
 type NewUserReq struct {
@@ -13,6 +22,36 @@ type NewUserReq struct {
 }
 
 type NewCommentReq struct {
-	PostId  int    `json:"post_id"`
+	PostId   int    `json:"post_id"`
+	ParentId int    `json:"parent_id"`
+	Content  string `json:"content"`
+}
+
+type EditCommentReq struct {
 	Content string `json:"content"`
 }
+
+type RoleReq struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+	Grant bool   `json:"grant"`
+}
+
+type MailTokenReq struct {
+	Token string `json:"token"`
+}
+
+type ResetReq struct {
+	Email string `json:"email"`
+}
+
+type ResetConfirmReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// UnlockReq either field can be empty
+type UnlockReq struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
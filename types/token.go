@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+type Token struct {
+	Email     string    `json:"email"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	// Signed the record backs a signed token and is keyed by its session id
+	Signed bool `json:"signed,omitempty"`
+}
+
+// Session a token as shown to its owner, the token itself is never shown
+type Session struct {
+	Id        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+type TwoFactorCodeReq struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginReq struct {
+	PreAuthToken string `json:"pre_auth_token"`
+	Code         string `json:"code"`
+}
+
+// TOTPEnrollment uri is shown as a QR code, secret is for typing by hand
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// PreAuth answer to a login with a password of a user with two factor
+// authentication, the token is exchanged for a session with a code
+type PreAuth struct {
+	PreAuthToken string    `json:"pre_auth_token"`
+	Expires      time.Time `json:"expires"`
+}
@@ -1,12 +1,55 @@
 package types
 
+// User Unverified is set at signup until the email is confirmed, users
+// stored before verification existed count as verified
 type User struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Name     string `json:"name"`
+	Email      string   `json:"email"`
+	Password   string   `json:"password"`
+	Name       string   `json:"name"`
+	Roles      []string `json:"roles"`
+	Unverified bool     `json:"unverified,omitempty"`
+
+	// TOTPSecret is set at enrollment, TOTPEnabled once a code confirms it
+	TOTPSecret  string `json:"totp_secret,omitempty"`
+	TOTPEnabled bool   `json:"totp_enabled,omitempty"`
+	// TOTPLastStep time step of the last accepted code
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes sha256 of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// OIDCSubject id of the user at the OpenID Connect provider, users
+	// created by the provider have no password
+	OIDCSubject string `json:"oidc_subject,omitempty"`
 }
 
 type UserInfo struct {
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Email       string   `json:"email"`
+	Name        string   `json:"name"`
+	Roles       []string `json:"roles"`
+	Unverified  bool     `json:"unverified,omitempty"`
+	TOTPEnabled bool     `json:"totp_enabled"`
+}
+
+const (
+	RoleReader    = "reader"
+	RoleAuthor    = "author"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles all known roles
+var Roles = []string{RoleReader, RoleAuthor, RoleModerator, RoleAdmin}
+
+// DefaultRoles roles of a new user, and of users stored before roles
+// existed, they have no roles field at all
+var DefaultRoles = []string{RoleReader, RoleAuthor}
+
+// HasRole admin has every role
+func (u *UserInfo) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
 }